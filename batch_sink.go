@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = 1000 * time.Millisecond
+	defaultMaxRetries    = 3
+
+	maxRetryBackoff = 10 * time.Second
+)
+
+var (
+	errSinkOverflow = errors.New("sink buffer is full, entry dropped")
+	errSinkClosed   = errors.New("sink is closed")
+)
+
+// batchOptions configures how a batchSink groups and retries entries. They are read from the <sink>-batch-size,
+// <sink>-flush-interval and <sink>-max-retries options of the sink
+type batchOptions struct {
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+}
+
+func parseBatchOptions(cfg map[string]string, sink string) (batchOptions, error) {
+	opts := batchOptions{
+		batchSize:     defaultBatchSize,
+		flushInterval: defaultFlushInterval,
+		maxRetries:    defaultMaxRetries,
+	}
+	if v, found := cfg[sink+"-batch-size"]; found {
+		batchSize, err := strconv.Atoi(v)
+		if err != nil || batchSize <= 0 {
+			return opts, fmt.Errorf("%s-batch-size must be a positive integer, got %q", sink, v)
+		}
+		opts.batchSize = batchSize
+	}
+	if v, found := cfg[sink+"-flush-interval"]; found {
+		flushInterval, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || flushInterval <= 0 {
+			return opts, fmt.Errorf("%s-flush-interval must be a positive number of milliseconds, got %q", sink, v)
+		}
+		opts.flushInterval = time.Duration(flushInterval) * time.Millisecond
+	}
+	if v, found := cfg[sink+"-max-retries"]; found {
+		maxRetries, err := strconv.Atoi(v)
+		if err != nil || maxRetries < 0 {
+			return opts, fmt.Errorf("%s-max-retries must be a non negative integer, got %q", sink, v)
+		}
+		opts.maxRetries = maxRetries
+	}
+	return opts, nil
+}
+
+// batchSink buffers entries and hands them to send in batches, either when batchSize entries are pending or every
+// flushInterval. Batches failing with a retryableError are retried with exponential backoff, until ctx is canceled
+type batchSink struct {
+	name string
+	opts batchOptions
+	ctx  context.Context
+	send func(ctx context.Context, batch []logging.Entry) error
+	// losses counts the entries of the batches dropped and records the metrics of the sink, set by nGCPLogger
+	// before any entry is logged
+	losses *lossTracker
+
+	entries   chan logging.Entry
+	flushes   chan chan error
+	closed    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newBatchSink(ctx context.Context, name string, opts batchOptions, send func(ctx context.Context, batch []logging.Entry) error) *batchSink {
+	b := &batchSink{
+		name:    name,
+		opts:    opts,
+		ctx:     ctx,
+		send:    send,
+		entries: make(chan logging.Entry, opts.batchSize*10),
+		flushes: make(chan chan error),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batchSink) String() string {
+	return b.name
+}
+
+func (b *batchSink) setLossTracker(t *lossTracker) {
+	b.losses = t
+}
+
+func (b *batchSink) Log(entry logging.Entry) error {
+	select {
+	case <-b.closed:
+		return errSinkClosed
+	default:
+	}
+	select {
+	case b.entries <- entry:
+		if b.losses != nil {
+			b.losses.metrics.enqueued(b.name, 1)
+		}
+		return nil
+	default:
+		return errSinkOverflow
+	}
+}
+
+func (b *batchSink) Flush() error {
+	reply := make(chan error, 1)
+	select {
+	case b.flushes <- reply:
+		return <-reply
+	case <-b.done:
+		return nil
+	}
+}
+
+func (b *batchSink) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+	<-b.done
+	return nil
+}
+
+func (b *batchSink) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.opts.flushInterval)
+	defer ticker.Stop()
+
+	var batch []logging.Entry
+	for {
+		select {
+		case entry := <-b.entries:
+			batch = append(batch, entry)
+			if len(batch) >= b.opts.batchSize {
+				b.logSendError(b.sendWithRetries(batch))
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				b.logSendError(b.sendWithRetries(batch))
+				batch = nil
+			}
+		case reply := <-b.flushes:
+			reply <- b.sendPending(batch)
+			batch = nil
+		case <-b.closed:
+			b.logSendError(b.sendPending(batch))
+			return
+		}
+	}
+}
+
+// sendPending sends the given batch along with all entries waiting in the channel
+func (b *batchSink) sendPending(batch []logging.Entry) error {
+	var firstErr error
+	for {
+	fill:
+		for len(batch) < b.opts.batchSize {
+			select {
+			case entry := <-b.entries:
+				batch = append(batch, entry)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			return firstErr
+		}
+		full := len(batch) >= b.opts.batchSize
+		if err := b.sendWithRetries(batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if !full {
+			return firstErr
+		}
+		batch = nil
+	}
+}
+
+func (b *batchSink) sendWithRetries(batch []logging.Entry) error {
+	var err error
+	start := time.Now()
+retries:
+	for attempt := 0; attempt <= b.opts.maxRetries; attempt++ {
+		if attempt > 0 {
+			backoff := time.NewTimer(min(100*time.Millisecond<<attempt, maxRetryBackoff))
+			select {
+			case <-backoff.C:
+			case <-b.ctx.Done():
+				backoff.Stop()
+				break retries
+			}
+		}
+		ctx, cancel := context.WithTimeout(b.ctx, 30*time.Second)
+		err = b.send(ctx, batch)
+		cancel()
+		var retryable retryableError
+		if err == nil || !errors.As(err, &retryable) {
+			break
+		}
+	}
+	if b.losses != nil {
+		b.losses.metrics.written(b.name, len(batch), 0, time.Since(start), err)
+	}
+	if err != nil {
+		if b.losses != nil {
+			b.losses.add(b.name, lossReasonOf(err), len(batch))
+		}
+		return fmt.Errorf("error sending %d entries to %s: %w", len(batch), b.name, err)
+	}
+	return nil
+}
+
+func (b *batchSink) logSendError(err error) {
+	if err != nil {
+		slog.Error("dropped batch", "sink", b.name, "error", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+const (
+	bundlerPresetKey        = "gcp-bundler-preset"
+	delayThresholdKey       = "gcp-delay-threshold"
+	entryCountThresholdKey  = "gcp-entry-count-threshold"
+	entryByteThresholdKey   = "gcp-entry-byte-threshold"
+	bufferedByteLimitKey    = "gcp-buffered-byte-limit"
+	concurrentWriteLimitKey = "gcp-concurrent-write-limit"
+
+	bundlerPresetLowLatency     = "low-latency"
+	bundlerPresetHighThroughput = "high-throughput"
+
+	// maxEntryByteThreshold keeps the requests below the 10MB limit of WriteLogEntries
+	maxEntryByteThreshold = 9 << 20
+)
+
+// bundlerOptions configures how the logger of a Cloud Logging destination batches entries. See the
+// logging.LoggerOption of each field
+type bundlerOptions struct {
+	delayThreshold       time.Duration
+	entryCountThreshold  int
+	entryByteThreshold   int
+	bufferedByteLimit    int
+	concurrentWriteLimit int
+}
+
+var (
+	defaultBundlerOptions = bundlerOptions{
+		delayThreshold:       logging.DefaultDelayThreshold,
+		entryCountThreshold:  logging.DefaultEntryCountThreshold,
+		entryByteThreshold:   logging.DefaultEntryByteThreshold,
+		bufferedByteLimit:    logging.DefaultBufferedByteLimit,
+		concurrentWriteLimit: 1,
+	}
+
+	// bundlerPresets are starting points for the bundler options, which can still be overridden one by one
+	bundlerPresets = map[string]bundlerOptions{
+		// Sends entries shortly after they are logged, in smaller batches written in parallel
+		bundlerPresetLowLatency: {
+			delayThreshold:       100 * time.Millisecond,
+			entryCountThreshold:  100,
+			entryByteThreshold:   1 << 20,
+			bufferedByteLimit:    logging.DefaultBufferedByteLimit,
+			concurrentWriteLimit: 4,
+		},
+		// Sends large batches, writing several of them in parallel so bursts don't overflow the buffer
+		bundlerPresetHighThroughput: {
+			delayThreshold:       2 * time.Second,
+			entryCountThreshold:  5000,
+			entryByteThreshold:   maxEntryByteThreshold,
+			bufferedByteLimit:    logging.DefaultBufferedByteLimit,
+			concurrentWriteLimit: 8,
+		},
+	}
+)
+
+func parseBundlerOptions(cfg map[string]string) (bundlerOptions, error) {
+	opts := defaultBundlerOptions
+	if preset, found := cfg[bundlerPresetKey]; found {
+		presetOpts, found := bundlerPresets[preset]
+		if !found {
+			return opts, fmt.Errorf("unsupported %s %q, must be %s or %s", bundlerPresetKey, preset, bundlerPresetLowLatency, bundlerPresetHighThroughput)
+		}
+		opts = presetOpts
+	}
+
+	if v, found := cfg[delayThresholdKey]; found {
+		delay, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || delay <= 0 {
+			return opts, fmt.Errorf("%s must be a positive number of milliseconds, got %q", delayThresholdKey, v)
+		}
+		opts.delayThreshold = time.Duration(delay) * time.Millisecond
+	}
+	for _, o := range []struct {
+		key   string
+		field *int
+	}{
+		{entryCountThresholdKey, &opts.entryCountThreshold},
+		{entryByteThresholdKey, &opts.entryByteThreshold},
+		{bufferedByteLimitKey, &opts.bufferedByteLimit},
+		{concurrentWriteLimitKey, &opts.concurrentWriteLimit},
+	} {
+		if v, found := cfg[o.key]; found {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return opts, fmt.Errorf("%s must be a positive integer, got %q", o.key, v)
+			}
+			*o.field = n
+		}
+	}
+
+	if opts.entryByteThreshold > maxEntryByteThreshold {
+		return opts, fmt.Errorf("%s can't be larger than %d, since Cloud Logging rejects requests over 10MB", entryByteThresholdKey, maxEntryByteThreshold)
+	}
+	if opts.bufferedByteLimit < opts.entryByteThreshold {
+		return opts, fmt.Errorf("%s (%d) can't be smaller than %s (%d)", bufferedByteLimitKey, opts.bufferedByteLimit, entryByteThresholdKey, opts.entryByteThreshold)
+	}
+	return opts, nil
+}
+
+func (o bundlerOptions) loggerOptions() []logging.LoggerOption {
+	return []logging.LoggerOption{
+		logging.DelayThreshold(o.delayThreshold),
+		logging.EntryCountThreshold(o.entryCountThreshold),
+		logging.EntryByteThreshold(o.entryByteThreshold),
+		logging.BufferedByteLimit(o.bufferedByteLimit),
+		logging.ConcurrentWriteLimit(o.concurrentWriteLimit),
+	}
+}
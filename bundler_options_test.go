@@ -0,0 +1,85 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func TestBundlerPresets(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config map[string]string
+		want   bundlerOptions
+	}{
+		"defaults": {
+			config: map[string]string{},
+			want:   defaultBundlerOptions,
+		},
+		"preset": {
+			config: map[string]string{bundlerPresetKey: bundlerPresetLowLatency},
+			want:   bundlerPresets[bundlerPresetLowLatency],
+		},
+		"preset with overrides": {
+			config: map[string]string{
+				bundlerPresetKey:        bundlerPresetHighThroughput,
+				delayThresholdKey:       "500",
+				concurrentWriteLimitKey: "2",
+			},
+			want: bundlerOptions{
+				delayThreshold:       500 * time.Millisecond,
+				entryCountThreshold:  5000,
+				entryByteThreshold:   maxEntryByteThreshold,
+				bufferedByteLimit:    bundlerPresets[bundlerPresetHighThroughput].bufferedByteLimit,
+				concurrentWriteLimit: 2,
+			},
+		},
+	} {
+		got, err := parseBundlerOptions(tc.config)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: options = %+v, want %+v", name, got, tc.want)
+		}
+	}
+
+	for name, cfg := range map[string]map[string]string{
+		"unknown preset":             {bundlerPresetKey: "fast"},
+		"entry byte threshold":       {entryByteThresholdKey: strconv.Itoa(maxEntryByteThreshold + 1)},
+		"buffer below the threshold": {bundlerPresetKey: bundlerPresetLowLatency, bufferedByteLimitKey: "1024"},
+	} {
+		if _, err := parseBundlerOptions(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// The entry count threshold overrides the one of the preset, which would batch the 4 entries together. The
+	// instrumentation entry of the client counts towards the threshold as well, so batches may be smaller
+	h := newTestHarness(t)
+	h.runContainer(t, logger.Info{
+		ContainerID: "batched-container",
+		Config: map[string]string{
+			projectOptKey:          testProject,
+			bundlerPresetKey:       bundlerPresetHighThroughput,
+			entryCountThresholdKey: "2",
+		},
+	}, "first", "second", "third", "fourth")
+	var batches []int
+	for _, req := range h.server.Requests() {
+		n := 0
+		for _, e := range req.GetEntries() {
+			if e.GetJsonPayload().GetFields()["container"].GetStructValue().GetFields()["id"].GetStringValue() == "batched-container" {
+				n++
+			}
+		}
+		if n > 0 {
+			batches = append(batches, n)
+		}
+	}
+	if len(batches) < 2 || slices.Max(batches) > 2 {
+		t.Errorf("expected the entries to be written in batches of at most 2, got %v", batches)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/logging"
+	"google.golang.org/api/option"
+	gtransport "google.golang.org/api/transport/grpc"
+	"google.golang.org/grpc"
+)
+
+const defaultLoggingEndpoint = "logging.googleapis.com:443"
+
+// connKey identifies the connections that can be shared, which authenticate with the same credentials through the
+// same endpoint
+type connKey struct {
+	credentials string
+	endpoint    string
+}
+
+type pooledConn struct {
+	key connKey
+	// ready is closed once the connection is dialed, setting conn or err
+	ready chan struct{}
+	conn  *grpc.ClientConn
+	err   error
+	refs  int
+	// pinged holds the projects the credentials were checked against
+	pinged map[string]bool
+}
+
+// sharedConn is the connection pool of the clients created on a pooled connection. Closing a client leaves the
+// connection open, since it is closed by releaseClient once no client uses it
+type sharedConn struct {
+	*grpc.ClientConn
+}
+
+func (c sharedConn) Conn() *grpc.ClientConn { return c.ClientConn }
+func (c sharedConn) Num() int               { return 1 }
+func (c sharedConn) Close() error           { return nil }
+
+// connPool holds the connections to Cloud Logging shared by all containers, so a host has one connection per
+// credentials and endpoint instead of one per container
+var connPool = struct {
+	mu    sync.Mutex
+	conns map[connKey]*pooledConn
+}{conns: make(map[connKey]*pooledConn)}
+
+// pooledClient is the client of a single container, created on a pooled connection. Each container has its own
+// client, so the errors reported to its OnError can be attributed to the container
+type pooledClient struct {
+	*logging.Client
+	conn *pooledConn
+}
+
+// acquireClient returns a client for the project on a pooled connection, connecting and authenticating it if there
+// is none yet. Waiting for the connection and pinging the project are canceled with ctx. Each call must be paired
+// with a call to releaseClient
+func acquireClient(ctx context.Context, project string, creds clientCredentials, ep endpointConfig, onError func(error)) (*pooledClient, error) {
+	key := connKey{credentials: creds.key(), endpoint: ep.String()}
+
+	// The connection is dialed without holding the pool lock, so loading slow credentials doesn't block the
+	// containers using other ones. The containers using the same ones wait for the first to dial it
+	connPool.mu.Lock()
+	pc, found := connPool.conns[key]
+	if !found {
+		pc = &pooledConn{key: key, ready: make(chan struct{}), pinged: make(map[string]bool)}
+		connPool.conns[key] = pc
+	}
+	pc.refs++
+	connPool.mu.Unlock()
+
+	if !found {
+		pc.conn, pc.err = dialLogging(creds, ep)
+		if pc.err != nil {
+			// Later containers dial again instead of getting the error of this attempt
+			connPool.mu.Lock()
+			if connPool.conns[key] == pc {
+				delete(connPool.conns, key)
+			}
+			connPool.mu.Unlock()
+		}
+		close(pc.ready)
+	}
+	select {
+	case <-pc.ready:
+	case <-ctx.Done():
+		releaseConn(pc)
+		return nil, ctx.Err()
+	}
+	if pc.err != nil {
+		releaseConn(pc)
+		return nil, pc.err
+	}
+
+	connPool.mu.Lock()
+	pinged := pc.pinged[project]
+	connPool.mu.Unlock()
+
+	c, err := logging.NewClient(context.Background(), project, gtransport.WithConnPool(sharedConn{pc.conn}))
+	if err != nil {
+		releaseConn(pc)
+		return nil, err
+	}
+	c.OnError = onError
+	if !pinged {
+		// The pool isn't locked while pinging, which is retried for as long as Cloud Logging is unreachable
+		if err := c.Ping(ctx); err != nil {
+			c.Close()
+			releaseConn(pc)
+			return nil, fmt.Errorf("unable to connect or authenticate with Google Cloud Logging for %s: %v", project, err)
+		}
+		connPool.mu.Lock()
+		pc.pinged[project] = true
+		connPool.mu.Unlock()
+	}
+	return &pooledClient{Client: c, conn: pc}, nil
+}
+
+// releaseClient closes the client, and its connection once no other client uses it
+func releaseClient(c *pooledClient) error {
+	return errors.Join(c.Close(), releaseConn(c.conn))
+}
+
+// releaseConn closes the connection once no client uses it
+func releaseConn(pc *pooledConn) error {
+	connPool.mu.Lock()
+	defer connPool.mu.Unlock()
+	pc.refs--
+	if pc.refs > 0 {
+		return nil
+	}
+	if connPool.conns[pc.key] == pc {
+		delete(connPool.conns, pc.key)
+	}
+	if pc.conn == nil {
+		return nil
+	}
+	return pc.conn.Close()
+}
+
+func dialLogging(creds clientCredentials, ep endpointConfig) (*grpc.ClientConn, error) {
+	endpointOpts, err := ep.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts := []option.ClientOption{
+		option.WithEndpoint(defaultLoggingEndpoint),
+		option.WithScopes(logging.WriteScope),
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(recordWriteResult)),
+	}
+	// Insecure endpoints don't authenticate, so the credentials are not even loaded
+	if !ep.insecure {
+		credsOpts, err := creds.clientOptions()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, credsOpts...)
+	}
+	opts = append(opts, endpointOpts...)
+	return gtransport.Dial(context.Background(), opts...)
+}
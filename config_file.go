@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/docker/docker/daemon/logger"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configFileEnv is the plugin setting with the path on the host of the configuration file
+	configFileEnv = "config-file"
+
+	profileKey = "profile"
+)
+
+// hostConfig is the configuration file currently loaded, nil if the config-file setting is not set. It is replaced
+// when the file is reloaded
+var hostConfig atomic.Pointer[configFile]
+
+// configFile holds the named profiles of log-opts and the rules applying them to containers, along with the named
+// credentials. It is read as YAML, so JSON files work as well
+type configFile struct {
+	Profiles    map[string]profile            `yaml:"profiles"`
+	Rules       []matchRule                   `yaml:"rules"`
+	Credentials map[string]credentialsProfile `yaml:"credentials"`
+
+	// digest is the hash of the content of the file, to skip reloading it when it didn't change
+	digest [sha256.Size]byte
+}
+
+// profile is a named set of log-opts, overridden by the log-opts of the daemon and the container
+type profile struct {
+	Options map[string]string `yaml:"options"`
+}
+
+// matchRule applies a profile to the containers matching all of its criteria. Image and name are glob patterns, as
+// in path.Match, and labels must have the given values
+type matchRule struct {
+	Image   string            `yaml:"image"`
+	Name    string            `yaml:"name"`
+	Labels  map[string]string `yaml:"labels"`
+	Profile string            `yaml:"profile"`
+}
+
+// loadHostConfig loads the configuration file of the config-file setting, through the /host mount
+func loadHostConfig() error {
+	file := os.Getenv(configFileEnv)
+	if file == "" {
+		return nil
+	}
+	c, err := parseConfigFile(hostConfigPath(file))
+	if err != nil {
+		return fmt.Errorf("invalid %s %s: %w", configFileEnv, file, err)
+	}
+	hostConfig.Store(c)
+	return nil
+}
+
+func hostConfigPath(file string) string {
+	return fmt.Sprintf("/host/%s", file)
+}
+
+func parseConfigFile(path string) (*configFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	c := configFile{digest: sha256.Sum256(b)}
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return &c, c.validate()
+}
+
+func (c *configFile) validate() error {
+	for name, p := range c.Profiles {
+		if _, found := p.Options[profileKey]; found {
+			return fmt.Errorf("profile %q: profiles can't set the %s option", name, profileKey)
+		}
+		if err := ValidateLogOpts(p.Options); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+	}
+	for name, p := range c.Credentials {
+		if p.File == "" && p.Impersonate == "" {
+			return fmt.Errorf("credentials %q must have a file or a service account to impersonate", name)
+		}
+	}
+	for i, r := range c.Rules {
+		if r.Image == "" && r.Name == "" && len(r.Labels) == 0 {
+			return fmt.Errorf("rule %d must match on image, name or labels", i+1)
+		}
+		for _, pattern := range []string{r.Image, r.Name} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d has an invalid pattern %q: %w", i+1, pattern, err)
+			}
+		}
+		if _, found := c.Profiles[r.Profile]; !found {
+			return fmt.Errorf("rule %d uses the unknown profile %q", i+1, r.Profile)
+		}
+	}
+	return nil
+}
+
+func (r matchRule) matches(info logger.Info) bool {
+	if r.Image != "" {
+		if matched, _ := path.Match(r.Image, info.ContainerImageName); !matched {
+			return false
+		}
+	}
+	if r.Name != "" {
+		if matched, _ := path.Match(r.Name, strings.TrimPrefix(info.ContainerName, "/")); !matched {
+			return false
+		}
+	}
+	for k, v := range r.Labels {
+		if info.ContainerLabels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// profileOf returns the profile named by the profile log-opt of the container, or else the one of the first rule
+// matching it. The name is empty if no profile applies
+func (c *configFile) profileOf(info logger.Info) (string, profile, error) {
+	if name, found := info.Config[profileKey]; found {
+		p, found := c.Profiles[name]
+		if !found {
+			names := make([]string, 0, len(c.Profiles))
+			for n := range c.Profiles {
+				names = append(names, n)
+			}
+			slices.Sort(names)
+			return "", p, fmt.Errorf("unknown %s %q, the configuration file has %s", profileKey, name, strings.Join(names, ", "))
+		}
+		return name, p, nil
+	}
+	for _, r := range c.Rules {
+		if r.matches(info) {
+			return r.Profile, c.Profiles[r.Profile], nil
+		}
+	}
+	return "", profile{}, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+const (
+	impersonateKey        = "credentials-impersonate"
+	delegatesKey          = "credentials-delegates"
+	credentialsProfileKey = "credentials-profile"
+
+	// credentialsDirEnv is the plugin setting with a directory on the host holding credentials files, used as the
+	// credentials profiles named after them, without the .json extension
+	credentialsDirEnv = "credentials-dir"
+
+	// cloudPlatformScope is the scope of the base credentials used to impersonate a service account, which the IAM
+	// Credentials API requires
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// allowExecutablesEnv is the plugin setting, read by the Google auth library, allowing external account
+	// configurations to run an executable to get their subject token
+	allowExecutablesEnv = "GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES"
+)
+
+// hostRoot is where the host filesystem is mounted in the plugin, which the credentials and CA files are read
+// through
+var hostRoot = "/host"
+
+// credentialsProfile is a named set of credentials defined in the configuration file, so containers reference them
+// with credentials-profile instead of holding them in their log-opts, which are visible with docker inspect
+type credentialsProfile struct {
+	File        string `yaml:"file"`
+	Impersonate string `yaml:"impersonate"`
+	Delegates   string `yaml:"delegates"`
+}
+
+// clientCredentials are the credentials a client authenticates with, the application default credentials when
+// empty. They are used as the base credentials to impersonate a service account with when impersonate is set
+type clientCredentials struct {
+	file string // path on the host
+	json string
+
+	impersonate string
+	delegates   string // comma separated chain of service accounts delegating to impersonate
+}
+
+// credentialsOf returns the credentials of the options, read with get. credentials-profile takes precedence over
+// credentials-file, which takes precedence over credentials-json
+func credentialsOf(get func(key string) string) (clientCredentials, error) {
+	c := clientCredentials{
+		file:        get(clientCredentialsFile),
+		impersonate: get(impersonateKey),
+		delegates:   get(delegatesKey),
+	}
+	if name := get(credentialsProfileKey); name != "" {
+		p, err := lookupCredentialsProfile(name)
+		if err != nil {
+			return c, err
+		}
+		c.file = p.File
+		if p.Impersonate != "" {
+			c.impersonate, c.delegates = p.Impersonate, p.Delegates
+		}
+		return c, nil
+	}
+	if c.file == "" {
+		c.json = get(clientCredentialsJSON)
+	}
+	return c, nil
+}
+
+// lookupCredentialsProfile returns the credentials profile of the configuration file with the given name, or else
+// the file of the same name in the directory of the credentials-dir setting
+func lookupCredentialsProfile(name string) (credentialsProfile, error) {
+	if c := hostConfig.Load(); c != nil {
+		if p, found := c.Credentials[name]; found {
+			return p, nil
+		}
+	}
+	dir := os.Getenv(credentialsDirEnv)
+	if dir == "" {
+		return credentialsProfile{}, fmt.Errorf("unknown %s %q, it is neither in the configuration file nor is the %s plugin setting set", credentialsProfileKey, name, credentialsDirEnv)
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return credentialsProfile{}, fmt.Errorf("invalid %s %q", credentialsProfileKey, name)
+	}
+	file := path.Join(dir, name+".json")
+	if _, err := os.Stat(path.Join(hostRoot, file)); err != nil {
+		return credentialsProfile{}, fmt.Errorf("unknown %s %q: %w", credentialsProfileKey, name, err)
+	}
+	return credentialsProfile{File: file}, nil
+}
+
+// key identifies the credentials without holding the secrets of credentials-json
+func (c clientCredentials) key() string {
+	key := "default"
+	if c.json != "" {
+		sum := sha256.Sum256([]byte(c.json))
+		key = "json:" + hex.EncodeToString(sum[:])
+	} else if c.file != "" {
+		key = "file:" + c.file
+	}
+	if c.impersonate != "" {
+		key += ";impersonate:" + c.impersonate + ";delegates:" + c.delegates
+	}
+	return key
+}
+
+func (c clientCredentials) clientOptions() ([]option.ClientOption, error) {
+	ts, err := c.tokenSource()
+	if err != nil || ts == nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithTokenSource(ts)}, nil
+}
+
+// tokenSource returns the token source of the credentials, nil for the application default credentials found by the
+// clients. The base credentials of an impersonation have the cloud-platform scope, which the IAM Credentials API
+// requires, the others only the scope to write logs
+func (c clientCredentials) tokenSource() (oauth2.TokenSource, error) {
+	scope := logging.WriteScope
+	if c.impersonate != "" {
+		scope = cloudPlatformScope
+	}
+	var base oauth2.TokenSource
+	if c.file != "" {
+		ts, err := newFileTokenSource(path.Join(hostRoot, c.file), scope)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the credentials of %s: %w", c.file, err)
+		}
+		base = ts
+	} else if c.json != "" {
+		b, err := hostExternalAccount([]byte(c.json))
+		if err != nil {
+			return nil, err
+		}
+		creds, err := google.CredentialsFromJSON(context.Background(), b, scope)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the credentials of %s: %w", clientCredentialsJSON, err)
+		}
+		base = creds.TokenSource
+	}
+	if c.impersonate == "" {
+		return base, nil
+	}
+
+	var opts []option.ClientOption
+	if base != nil {
+		opts = append(opts, option.WithTokenSource(base))
+	}
+	var delegates []string
+	for _, d := range strings.Split(c.delegates, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			delegates = append(delegates, d)
+		}
+	}
+	ts, err := impersonate.CredentialsTokenSource(context.Background(), impersonate.CredentialsConfig{
+		TargetPrincipal: c.impersonate,
+		Scopes:          []string{logging.WriteScope},
+		Delegates:       delegates,
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error impersonating %s: %w", c.impersonate, err)
+	}
+	return ts, nil
+}
+
+// hostExternalAccount rewrites the files of an external account configuration, used for workload identity
+// federation, to their paths through the host mount: the subject token file, or the output file of the executable
+// getting the token. Configurations with an executable are rejected unless the allowExecutablesEnv setting allows
+// them. Other credentials are returned as is
+func hostExternalAccount(credentialsJSON []byte) ([]byte, error) {
+	var config map[string]any
+	if err := json.Unmarshal(credentialsJSON, &config); err != nil {
+		return nil, fmt.Errorf("invalid credentials: %w", err)
+	}
+	if config["type"] != "external_account" {
+		return credentialsJSON, nil
+	}
+	source, _ := config["credential_source"].(map[string]any)
+	if file, _ := source["file"].(string); file != "" {
+		source["file"] = path.Join(hostRoot, file)
+	}
+	if executable, isExecutable := source["executable"].(map[string]any); isExecutable {
+		if os.Getenv(allowExecutablesEnv) != "1" {
+			return nil, fmt.Errorf("the external account credentials run an executable, which requires the %s plugin setting to be 1", allowExecutablesEnv)
+		}
+		if file, _ := executable["output_file"].(string); file != "" {
+			executable["output_file"] = path.Join(hostRoot, file)
+		}
+	}
+	return json.Marshal(config)
+}
+
+// fileTokenSource is the token source of a credentials file, which is loaded again when it changes, so rotated keys
+// are picked up by the connections already using the file
+type fileTokenSource struct {
+	path  string
+	scope string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	ts      oauth2.TokenSource
+}
+
+func newFileTokenSource(path, scope string) (*fileTokenSource, error) {
+	s := &fileTokenSource{path: path, scope: scope}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Token returns a token of the current credentials of the file. The previous credentials are kept if the file
+// can't be loaded, such as while it is being written
+func (s *fileTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fi, err := os.Stat(s.path); err == nil && (!fi.ModTime().Equal(s.modTime) || fi.Size() != s.size) {
+		if err := s.load(); err != nil {
+			slog.Error("error reloading the credentials file, keeping the previous credentials", "file", s.path, "error", err)
+		} else {
+			slog.Info("reloaded the credentials file", "file", s.path)
+		}
+	}
+	return s.ts.Token()
+}
+
+func (s *fileTokenSource) load() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	if b, err = hostExternalAccount(b); err != nil {
+		return err
+	}
+	creds, err := google.CredentialsFromJSON(context.Background(), b, s.scope)
+	if err != nil {
+		return err
+	}
+	s.ts = creds.TokenSource
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	return nil
+}
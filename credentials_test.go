@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"golang.org/x/oauth2"
+)
+
+// generateAccessTokenRequest is a call to the generateAccessToken method of the IAM Credentials API
+type generateAccessTokenRequest struct {
+	principal string
+	Delegates []string `json:"delegates"`
+	Scope     []string `json:"scope"`
+}
+
+// iamStub stands in for the Google token endpoints and the IAM Credentials API, recording the scopes of the base
+// tokens and the impersonation requests. The base tokens are only accepted by the IAM Credentials API when they
+// have the cloud-platform scope
+type iamStub struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	baseScopes  [][]string
+	impersonate []generateAccessTokenRequest
+}
+
+// newIAMStub starts an iamStub, sending all HTTPS requests of the Google libraries to it for the rest of the test
+func newIAMStub(t *testing.T) *iamStub {
+	t.Helper()
+	s := &iamStub{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+
+	transport := s.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, s.Listener.Addr().String())
+	}
+	prevTransport := http.DefaultTransport
+	http.DefaultTransport = transport
+	t.Cleanup(func() { http.DefaultTransport = prevTransport })
+	return s
+}
+
+func (s *iamStub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/token":
+		// Service account keys exchange a JWT holding the scopes
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "invalid assertion", http.StatusBadRequest)
+			return
+		}
+		b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims struct {
+			Scope string `json:"scope"`
+		}
+		json.Unmarshal(b, &claims)
+		s.base(w, strings.Fields(claims.Scope))
+	case r.URL.Path == "/sts":
+		// External accounts exchange their subject token with the scopes in the form
+		r.ParseForm()
+		s.base(w, strings.Fields(r.Form.Get("scope")))
+	case strings.HasSuffix(r.URL.Path, ":generateAccessToken"):
+		if r.Header.Get("Authorization") != "Bearer base-token-"+cloudPlatformScope {
+			http.Error(w, "the base token needs the cloud-platform scope", http.StatusForbidden)
+			return
+		}
+		var req generateAccessTokenRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		req.principal = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/-/serviceAccounts/"), ":generateAccessToken")
+		s.mu.Lock()
+		s.impersonate = append(s.impersonate, req)
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{
+			"accessToken": "impersonated-token",
+			"expireTime":  time.Now().Add(time.Hour).Format(time.RFC3339),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// base responds with a base token named after its scopes
+func (s *iamStub) base(w http.ResponseWriter, scopes []string) {
+	s.mu.Lock()
+	s.baseScopes = append(s.baseScopes, scopes)
+	s.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token":      "base-token-" + strings.Join(scopes, ","),
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"token_type":        "Bearer",
+		"expires_in":        3600,
+	})
+}
+
+func (s *iamStub) requests() ([][]string, []generateAccessTokenRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.baseScopes), slices.Clone(s.impersonate)
+}
+
+// serviceAccountKey returns a service account key exchanged for tokens at the token endpoint of the stub
+func (s *iamStub) serviceAccountKey(t *testing.T, email string) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": email,
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    s.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// tokenOf returns a token of the credentials, as used by the clients
+func tokenOf(t *testing.T, c clientCredentials) *oauth2.Token {
+	t.Helper()
+	ts, err := c.tokenSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestImpersonationScopes(t *testing.T) {
+	stub := newIAMStub(t)
+	prevHostRoot := hostRoot
+	hostRoot = t.TempDir()
+	t.Cleanup(func() { hostRoot = prevHostRoot })
+	if err := os.MkdirAll(filepath.Join(hostRoot, "etc/gcp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	key := stub.serviceAccountKey(t, "base@test-project.iam.gserviceaccount.com")
+	if err := os.WriteFile(filepath.Join(hostRoot, "etc/gcp/base.json"), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	prev := hostConfig.Load()
+	t.Cleanup(func() { hostConfig.Store(prev) })
+	hostConfig.Store(&configFile{Credentials: map[string]credentialsProfile{
+		"writer": {File: "/etc/gcp/base.json", Impersonate: "writer@test-project.iam.gserviceaccount.com", Delegates: "relay@test-project.iam.gserviceaccount.com"},
+	}})
+
+	for name, opts := range map[string]map[string]string{
+		"credentials file": {
+			clientCredentialsFile: "/etc/gcp/base.json",
+			impersonateKey:        "writer@test-project.iam.gserviceaccount.com",
+			delegatesKey:          "relay@test-project.iam.gserviceaccount.com",
+		},
+		"credentials profile": {credentialsProfileKey: "writer"},
+		"credentials json": {
+			clientCredentialsJSON: string(key),
+			impersonateKey:        "writer@test-project.iam.gserviceaccount.com",
+			delegatesKey:          "relay@test-project.iam.gserviceaccount.com",
+		},
+	} {
+		stub.mu.Lock()
+		stub.baseScopes, stub.impersonate = nil, nil
+		stub.mu.Unlock()
+
+		c, err := credentialsOf(func(k string) string { return opts[k] })
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if token := tokenOf(t, c); token.AccessToken != "impersonated-token" {
+			t.Errorf("%s: token = %q, want the impersonated token", name, token.AccessToken)
+		}
+		baseScopes, impersonated := stub.requests()
+		if len(baseScopes) != 1 || !slices.Equal(baseScopes[0], []string{cloudPlatformScope}) {
+			t.Errorf("%s: base token scopes = %v, want %s", name, baseScopes, cloudPlatformScope)
+		}
+		want := generateAccessTokenRequest{
+			principal: "writer@test-project.iam.gserviceaccount.com",
+			Delegates: []string{"projects/-/serviceAccounts/relay@test-project.iam.gserviceaccount.com"},
+			Scope:     []string{logging.WriteScope},
+		}
+		if len(impersonated) != 1 || impersonated[0].principal != want.principal ||
+			!slices.Equal(impersonated[0].Delegates, want.Delegates) || !slices.Equal(impersonated[0].Scope, want.Scope) {
+			t.Errorf("%s: impersonation requests = %+v, want %+v", name, impersonated, want)
+		}
+	}
+
+	// Without impersonation, the file is loaded with the scope of the logging client
+	stub.mu.Lock()
+	stub.baseScopes = nil
+	stub.mu.Unlock()
+	if token := tokenOf(t, clientCredentials{file: "/etc/gcp/base.json"}); token.AccessToken != "base-token-"+logging.WriteScope {
+		t.Errorf("token = %q, want a token with the %s scope", token.AccessToken, logging.WriteScope)
+	}
+}
+
+func TestExternalAccountCredentials(t *testing.T) {
+	externalAccount := `{
+		"type": "external_account",
+		"audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url": "https://sts.googleapis.com/v1/token",
+		"credential_source": {"file": "/var/run/secrets/token"}
+	}`
+	b, err := hostExternalAccount([]byte(externalAccount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		CredentialSource struct {
+			File string `json:"file"`
+		} `json:"credential_source"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.CredentialSource.File, "/host/var/run/secrets/token"; got != want {
+		t.Errorf("token file = %q, want %q", got, want)
+	}
+
+	serviceAccount := `{"type": "service_account", "project_id": "p"}`
+	if b, err := hostExternalAccount([]byte(serviceAccount)); err != nil || string(b) != serviceAccount {
+		t.Errorf("service account credentials were changed to %s (%v)", b, err)
+	}
+
+	executableAccount := `{
+		"type": "external_account",
+		"audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url": "https://sts.googleapis.com/v1/token",
+		"credential_source": {"executable": {"command": "/host/usr/local/bin/get-token", "output_file": "/var/cache/token.json"}}
+	}`
+	t.Setenv(allowExecutablesEnv, "")
+	if _, err := hostExternalAccount([]byte(executableAccount)); err == nil || !strings.Contains(err.Error(), allowExecutablesEnv) {
+		t.Errorf("expected executables to be rejected unless %s is set, got %v", allowExecutablesEnv, err)
+	}
+	t.Setenv(allowExecutablesEnv, "1")
+	b, err = hostExternalAccount([]byte(executableAccount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var executableConfig struct {
+		CredentialSource struct {
+			Executable struct {
+				OutputFile string `json:"output_file"`
+			} `json:"executable"`
+		} `json:"credential_source"`
+	}
+	if err := json.Unmarshal(b, &executableConfig); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := executableConfig.CredentialSource.Executable.OutputFile, "/host/var/cache/token.json"; got != want {
+		t.Errorf("output file = %q, want %q", got, want)
+	}
+
+	// The federated token is the base credentials of the impersonation
+	stub := newIAMStub(t)
+	prevHostRoot := hostRoot
+	hostRoot = t.TempDir()
+	t.Cleanup(func() { hostRoot = prevHostRoot })
+	if err := os.WriteFile(filepath.Join(hostRoot, "token"), []byte("subject-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	federated := strings.NewReplacer(
+		"https://sts.googleapis.com/v1/token", stub.URL+"/sts",
+		"/var/run/secrets/token", "/token",
+	).Replace(externalAccount)
+	creds, err := credentialsOf(func(k string) string {
+		return map[string]string{
+			clientCredentialsJSON: federated,
+			impersonateKey:        "writer@test-project.iam.gserviceaccount.com",
+			delegatesKey:          "relay-1@test-project.iam.gserviceaccount.com, relay-2@test-project.iam.gserviceaccount.com",
+		}[k]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := tokenOf(t, creds); token.AccessToken != "impersonated-token" {
+		t.Errorf("token = %q, want the impersonated token", token.AccessToken)
+	}
+	baseScopes, impersonated := stub.requests()
+	if len(baseScopes) != 1 || !slices.Equal(baseScopes[0], []string{cloudPlatformScope}) {
+		t.Errorf("federated token scopes = %v, want %s", baseScopes, cloudPlatformScope)
+	}
+	wantDelegates := []string{
+		"projects/-/serviceAccounts/relay-1@test-project.iam.gserviceaccount.com",
+		"projects/-/serviceAccounts/relay-2@test-project.iam.gserviceaccount.com",
+	}
+	if len(impersonated) != 1 || impersonated[0].principal != "writer@test-project.iam.gserviceaccount.com" ||
+		!slices.Equal(impersonated[0].Delegates, wantDelegates) || !slices.Equal(impersonated[0].Scope, []string{logging.WriteScope}) {
+		t.Errorf("impersonation requests = %+v, want writer@test-project.iam.gserviceaccount.com through %v", impersonated, wantDelegates)
+	}
+}
+
+func TestExternalAccountReadsHostTokenFile(t *testing.T) {
+	prevHostRoot := hostRoot
+	hostRoot = t.TempDir()
+	t.Cleanup(func() { hostRoot = prevHostRoot })
+
+	// The token exchange only succeeds with the subject token of the file
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if got := r.Form.Get("subject_token"); got != "subject-token-from-host" {
+			http.Error(w, "unexpected subject token "+got, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":      "federated-token",
+			"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+			"token_type":        "Bearer",
+			"expires_in":        3600,
+		})
+	}))
+	t.Cleanup(sts.Close)
+
+	for file, content := range map[string]string{
+		"var/run/secrets/token": "subject-token-from-host",
+		"etc/gcp/wif.json": `{
+			"type": "external_account",
+			"audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+			"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+			"token_url": "` + sts.URL + `",
+			"credential_source": {"file": "/var/run/secrets/token"}
+		}`,
+	} {
+		path := filepath.Join(hostRoot, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts, err := newFileTokenSource(filepath.Join(hostRoot, "etc/gcp/wif.json"), logging.WriteScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "federated-token" {
+		t.Errorf("token = %q, want the token exchanged for the subject token of the host file", token.AccessToken)
+	}
+}
+
+func TestCredentialsProfiles(t *testing.T) {
+	prev := hostConfig.Load()
+	t.Cleanup(func() { hostConfig.Store(prev) })
+	hostConfig.Store(&configFile{Credentials: map[string]credentialsProfile{
+		"prod-logs": {File: "/etc/gcp/prod.json", Impersonate: "writer@test-project.iam.gserviceaccount.com"},
+	}})
+
+	opts := map[string]string{credentialsProfileKey: "prod-logs", clientCredentialsJSON: `{"type": "service_account"}`}
+	creds, err := credentialsOf(func(k string) string { return opts[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := clientCredentials{file: "/etc/gcp/prod.json", impersonate: "writer@test-project.iam.gserviceaccount.com"}
+	if creds != want {
+		t.Errorf("credentials = %+v, want %+v", creds, want)
+	}
+
+	opts[credentialsProfileKey] = "missing"
+	if _, err := credentialsOf(func(k string) string { return opts[k] }); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestCredentialsFileIsReloaded(t *testing.T) {
+	// The token endpoint issues tokens named after the service account of the assertion
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var jwt struct {
+			Iss string `json:"iss"`
+		}
+		json.Unmarshal(claims, &jwt)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "token-of-" + jwt.Iss, "token_type": "Bearer", "expires_in": 3600})
+	}))
+	t.Cleanup(tokens.Close)
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	writeKey := func(email string) {
+		t.Helper()
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		b, _ := json.Marshal(map[string]string{
+			"type":         "service_account",
+			"client_email": email,
+			"private_key":  string(pemKey),
+			"token_uri":    tokens.URL,
+		})
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeKey("old@test-project.iam.gserviceaccount.com")
+	ts, err := newFileTokenSource(path, logging.WriteScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantToken := func(email string) {
+		t.Helper()
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "token-of-" + email; token.AccessToken != want {
+			t.Errorf("token = %q, want %q", token.AccessToken, want)
+		}
+	}
+	wantToken("old@test-project.iam.gserviceaccount.com")
+
+	// Rotating the key replaces the cached token of the old one
+	writeKey("new@test-project.iam.gserviceaccount.com")
+	wantToken("new@test-project.iam.gserviceaccount.com")
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/logging"
+	"github.com/docker/docker/daemon/logger"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+const (
+	routesKey             = "gcp-routes"
+	mirrorDestinationsKey = "gcp-mirror-destinations"
+
+	defaultLogName = "ngcplogs-docker-driver"
+)
+
+// destination identifies where in Cloud Logging entries are written to. It is parsed from strings with the format
+// project[/log-name][@credentials], where credentials is either the absolute path of a credentials file on the host or
+// the name of a credentials profile
+type destination struct {
+	project     string
+	logName     string
+	credentials string
+}
+
+func parseDestination(s string) (destination, error) {
+	var dst destination
+	s = strings.TrimSpace(s)
+	if at := strings.Index(s, "@"); at >= 0 {
+		dst.credentials = s[at+1:]
+		s = s[:at]
+		if dst.credentials == "" {
+			return dst, fmt.Errorf("destination %q has empty credentials", s)
+		}
+	}
+	if slash := strings.Index(s, "/"); slash >= 0 {
+		dst.logName = s[slash+1:]
+		s = s[:slash]
+	}
+	dst.project = s
+	if dst.project == "" {
+		return dst, errors.New("destination is missing the project")
+	}
+	if dst.logName == "" {
+		dst.logName = defaultLogName
+	}
+	return dst, nil
+}
+
+func (d destination) String() string {
+	return d.project + "/" + d.logName
+}
+
+// clientCredentials returns the credentials the destination is written with, which are those of the container
+// unless the destination has its own
+func (d destination) clientCredentials(container clientCredentials) (clientCredentials, error) {
+	switch {
+	case d.credentials == "":
+		return container, nil
+	case strings.HasPrefix(d.credentials, "/"):
+		return clientCredentials{file: d.credentials}, nil
+	}
+	p, err := lookupCredentialsProfile(d.credentials)
+	if err != nil {
+		return clientCredentials{}, fmt.Errorf("destination %s: %w", d, err)
+	}
+	return clientCredentials{file: p.File, impersonate: p.Impersonate, delegates: p.Delegates}, nil
+}
+
+// parseMirrorDestinations parses the comma separated list of destinations every entry is mirrored to
+func parseMirrorDestinations(s string) ([]destination, error) {
+	var destinations []destination
+	for _, d := range strings.Split(s, ",") {
+		if strings.TrimSpace(d) == "" {
+			continue
+		}
+		dst, err := parseDestination(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", mirrorDestinationsKey, err)
+		}
+		destinations = append(destinations, dst)
+	}
+	return destinations, nil
+}
+
+// gcpDestination is the Cloud Logging Sink, holding a destination with the client and logger used to write to it.
+// Each destination has its own logger, so entries are buffered independently and a failing destination does not
+// affect the others. The client is the container's own, on a connection shared with the other destinations using
+// the same credentials and endpoint
+type gcpDestination struct {
+	destination
+	client  *pooledClient
+	logger  *logging.Logger
+	metrics *containerMetrics
+}
+
+func newGcpDestination(ctx context.Context, dst destination, creds clientCredentials, ep endpointConfig, losses *lossTracker, loggerOpts ...logging.LoggerOption) (*gcpDestination, error) {
+	c, err := acquireClient(ctx, dst.project, creds, ep, losses.onError(dst.String()))
+	if err != nil {
+		return nil, err
+	}
+	loggerOpts = append(slices.Clip(loggerOpts), losses.recordWrites(ctx, dst.String()))
+	return &gcpDestination{
+		destination: dst,
+		client:      c,
+		logger:      c.Logger(dst.logName, loggerOpts...),
+		metrics:     losses.metrics,
+	}, nil
+}
+
+func (d *gcpDestination) Log(entry logging.Entry) error {
+	d.metrics.enqueued(d.String(), 1)
+	d.logger.Log(entry)
+	return nil
+}
+
+func (d *gcpDestination) Flush() error {
+	return d.logger.Flush()
+}
+
+// Close flushes the logger of the destination and closes its client, along with the connection if no other
+// destination uses it
+func (d *gcpDestination) Close() error {
+	return errors.Join(d.logger.Flush(), releaseClient(d.client))
+}
+
+// newGcpSinks creates the Cloud Logging destinations of a container, which are the routed destination or the
+// configured project, followed by the mirror destinations. The project of the primary destination is returned
+// along with them. In lazy startup mode, the destinations are connected in the background. Canceling ctx cancels the
+// connection attempts and writes in progress
+func newGcpSinks(ctx context.Context, info logger.Info, resource *mrpb.MonitoredResource, losses *lossTracker) ([]Sink, string, error) {
+	routedDestination, err := matchRoute(info)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var project string
+	if projectID != "" {
+		project = projectID
+	}
+	if projectID, found := info.Config[projectOptKey]; found {
+		project = projectID
+	}
+	if routedDestination != nil {
+		project = routedDestination.project
+	}
+	if project == "" {
+		return nil, "", fmt.Errorf("no project was specified and couldn't read project from the metadata server. Please specify a project")
+	}
+
+	creds, err := credentialsOf(func(k string) string { return info.Config[k] })
+	if err != nil {
+		return nil, "", err
+	}
+
+	mirrors, err := parseMirrorDestinations(info.Config[mirrorDestinationsKey])
+	if err != nil {
+		return nil, "", err
+	}
+
+	ep, err := parseEndpointConfig(info.Config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	startup, err := parseStartupOptions(info.Config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bundler, err := parseBundlerOptions(info.Config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	loggerOpts := bundler.loggerOptions()
+	if resource != nil {
+		loggerOpts = append(loggerOpts, logging.CommonResource(resource))
+	}
+
+	destinations := []destination{{project: project, logName: defaultLogName}}
+	if routedDestination != nil {
+		destinations[0] = *routedDestination
+	}
+	destinations = append(destinations, mirrors...)
+	var connectors []func() (*gcpDestination, error)
+	for _, dst := range destinations {
+		dstCreds, err := dst.clientCredentials(creds)
+		if err != nil {
+			return nil, "", err
+		}
+		connectors = append(connectors, func() (*gcpDestination, error) {
+			return newGcpDestination(ctx, dst, dstCreds, ep, losses, loggerOpts...)
+		})
+	}
+
+	var sinks []Sink
+	for i, connect := range connectors {
+		var s Sink
+		if startup.lazy {
+			s, err = newLazySink(info.ContainerID, destinations[i], startup, losses, connect)
+		} else {
+			s, err = connect()
+		}
+		if err != nil {
+			closeSinks(sinks)
+			return nil, "", err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, project, nil
+}
+
+// route sends the logs of containers with a matching label to a destination
+type route struct {
+	labelKey    string
+	labelValue  string
+	destination destination
+}
+
+// parseRoutes parses the gcp-routes option, which contains semicolon separated rules with the format
+// label=value:destination, for example team=payments:payments-prod@/etc/gcp/payments.json
+func parseRoutes(s string) ([]route, error) {
+	var routes []route
+	for _, rule := range strings.Split(s, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		match, dst, found := strings.Cut(rule, ":")
+		if !found {
+			return nil, fmt.Errorf("route %q must have the format label=value:destination", rule)
+		}
+		labelKey, labelValue, found := strings.Cut(match, "=")
+		if !found || labelKey == "" {
+			return nil, fmt.Errorf("route %q must match on a label with the format label=value", rule)
+		}
+		parsedDst, err := parseDestination(dst)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", rule, err)
+		}
+		routes = append(routes, route{
+			labelKey:    labelKey,
+			labelValue:  labelValue,
+			destination: parsedDst,
+		})
+	}
+	return routes, nil
+}
+
+// matchRoute returns the destination of the first route matching the container labels
+func matchRoute(info logger.Info) (*destination, error) {
+	routes, err := parseRoutes(info.Config[routesKey])
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if v, found := info.ContainerLabels[r.labelKey]; found && v == r.labelValue {
+			return &r.destination, nil
+		}
+	}
+	return nil, nil
+}
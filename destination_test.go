@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes("team=payments:payments-prod@/etc/gcp/payments.json; team=search:search-prod/search-logs@search-logs;tier=web:web-prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []route{
+		{labelKey: "team", labelValue: "payments", destination: destination{project: "payments-prod", logName: defaultLogName, credentials: "/etc/gcp/payments.json"}},
+		{labelKey: "team", labelValue: "search", destination: destination{project: "search-prod", logName: "search-logs", credentials: "search-logs"}},
+		{labelKey: "tier", labelValue: "web", destination: destination{project: "web-prod", logName: defaultLogName}},
+	}
+	if !slices.Equal(routes, want) {
+		t.Errorf("routes = %+v, want %+v", routes, want)
+	}
+
+	for _, invalid := range []string{"payments-prod", "team:payments-prod", "=payments:payments-prod", "team=payments:", "team=payments:payments-prod@"} {
+		if _, err := parseRoutes(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestDestinationCredentials(t *testing.T) {
+	prev := hostConfig.Load()
+	t.Cleanup(func() { hostConfig.Store(prev) })
+	hostConfig.Store(&configFile{Credentials: map[string]credentialsProfile{
+		"search-logs": {File: "/etc/gcp/search.json", Impersonate: "search@test-project.iam.gserviceaccount.com"},
+	}})
+	container := clientCredentials{file: "/etc/gcp/app.json", impersonate: "app@test-project.iam.gserviceaccount.com"}
+
+	for credentials, want := range map[string]clientCredentials{
+		"":                       container,
+		"/etc/gcp/payments.json": {file: "/etc/gcp/payments.json"},
+		"search-logs":            {file: "/etc/gcp/search.json", impersonate: "search@test-project.iam.gserviceaccount.com"},
+	} {
+		got, err := destination{project: "p", logName: defaultLogName, credentials: credentials}.clientCredentials(container)
+		if err != nil {
+			t.Fatalf("%q: %v", credentials, err)
+		}
+		if got != want {
+			t.Errorf("credentials of %q = %+v, want %+v", credentials, got, want)
+		}
+	}
+	if _, err := (destination{project: "p", credentials: "missing"}).clientCredentials(container); err == nil {
+		t.Error("expected an error for an unknown credentials profile")
+	}
+}
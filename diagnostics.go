@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// diagnosticsAddressEnv is the plugin setting with the address the diagnostics are served on, either host:port or
+// unix:///path for a socket inside the plugin's rootfs. Diagnostics are not served if empty
+const diagnosticsAddressEnv = "diagnostics-address"
+
+// secretOptions are the options whose values are redacted from the diagnostics
+var secretOptions = []string{clientCredentialsJSON, otlpHeadersKey, webhookURLKey}
+
+// serveDiagnostics serves pprof, expvar, a goroutine dump and the loggers of the driver on the address of the
+// diagnostics-address setting, if set
+func serveDiagnostics(d *driver) error {
+	address := os.Getenv(diagnosticsAddressEnv)
+	if address == "" {
+		return nil
+	}
+	l, err := listen(address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s %q: %w", diagnosticsAddressEnv, address, err)
+	}
+
+	expvar.Publish("containers", expvar.Func(func() any {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.fileToLogWrapperMap)
+	}))
+	expvar.Publish("stopping", expvar.Func(func() any {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.stopping)
+	}))
+	expvar.Publish("connections", expvar.Func(func() any {
+		connPool.mu.Lock()
+		defer connPool.mu.Unlock()
+		return len(connPool.conns)
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		buf := make([]byte, 1<<20)
+		for {
+			n := runtime.Stack(buf, true)
+			if n < len(buf) {
+				w.Write(buf[:n])
+				return
+			}
+			buf = make([]byte, 2*len(buf))
+		}
+	})
+	mux.HandleFunc("/debug/loggers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(d.loggers())
+	})
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("error serving diagnostics", "error", err)
+		}
+	}()
+	slog.Info("serving diagnostics", "address", address)
+	return nil
+}
+
+// loggerDiagnostics is an entry of fileToLogWrapperMap, as served by the diagnostics
+type loggerDiagnostics struct {
+	File        string            `json:"file"`
+	ContainerID string            `json:"containerId"`
+	Name        string            `json:"name"`
+	LogPath     string            `json:"logPath"`
+	Config      map[string]string `json:"config"`
+	Sinks       []sinkHealth      `json:"sinks"`
+}
+
+// loggers returns the loggers of fileToLogWrapperMap, sorted by FIFO path
+func (d *driver) loggers() []loggerDiagnostics {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	loggers := make([]loggerDiagnostics, 0, len(d.fileToLogWrapperMap))
+	for file, lf := range d.fileToLogWrapperMap {
+		cfg := maps.Clone(lf.config())
+		for _, k := range secretOptions {
+			if _, found := cfg[k]; found {
+				cfg[k] = "[redacted]"
+			}
+		}
+		loggers = append(loggers, loggerDiagnostics{
+			File:        file,
+			ContainerID: lf.info.ContainerID,
+			Name:        lf.info.ContainerName,
+			LogPath:     lf.info.LogPath,
+			Config:      cfg,
+			Sinks:       lf.logger().health(),
+		})
+	}
+	slices.SortFunc(loggers, func(a, b loggerDiagnostics) int { return strings.Compare(a.File, b.File) })
+	return loggers
+}
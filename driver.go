@@ -30,17 +30,23 @@ type driver struct {
 	mu                         sync.Mutex
 	fileToLogWrapperMap        map[string]*logPair
 	containerIdToLogWrapperMap map[string]*logPair
+	// stopping holds the pairs of the stopped containers that are still being flushed
+	stopping map[*logPair]struct{}
 }
 
 var (
 	localLoggingConfig  = "local-logging"
 	sleepIntervalConfig = "sleep-interval"
+	flushTimeoutConfig  = "flush-timeout"
 )
 
+const defaultFlushTimeout = 10 * time.Second
+
 func createDriver() *driver {
 	return &driver{
 		fileToLogWrapperMap:        make(map[string]*logPair),
 		containerIdToLogWrapperMap: make(map[string]*logPair),
+		stopping:                   make(map[*logPair]struct{}),
 		sLog:                       slog.Default(),
 	}
 }
@@ -51,6 +57,18 @@ func (d *driver) logAndReturnError(err error, msg string) error {
 }
 
 func (d *driver) StartLogging(file string, info logger.Info) error {
+	if shuttingDown.Load() {
+		return d.logAndReturnError(errShuttingDown, "Refusing to start logging")
+	}
+	rawConfig := info.Config
+	cfg, err := resolveOptions(info)
+	if err != nil {
+		return d.logAndReturnError(err, "Error resolving the logger options")
+	}
+	if err := ValidateLogOpts(cfg); err != nil {
+		return d.logAndReturnError(fmt.Errorf("invalid ngcplogs options: %w", err), "Error validating the logger options")
+	}
+	info.Config = cfg
 	if info.LogPath == "" {
 		info.LogPath = filepath.Join("/var/log/docker", info.ContainerID)
 	}
@@ -65,20 +83,30 @@ func (d *driver) StartLogging(file string, info logger.Info) error {
 
 	gLogger, err := New(info)
 	if err != nil {
+		jsonl.Close()
 		return d.logAndReturnError(err, "Error creating GCP logger")
 	}
 
 	logFileReader, err := fifo.OpenFifo(context.Background(), file, syscall.O_RDONLY, 0700)
 	if err != nil {
+		gLogger.Close()
+		jsonl.Close()
 		return d.logAndReturnError(err, "Error opening log file")
 	}
 
 	d.mu.Lock()
 	lf := &logPair{
-		jsonl:   jsonl,
-		gLogger: gLogger,
-		logFile: logFileReader,
-		info:    info,
+		jsonl:     jsonl,
+		gLogger:   gLogger,
+		logFile:   logFileReader,
+		info:      info,
+		rawConfig: rawConfig,
+		done:      make(chan struct{}),
+	}
+	if shuttingDown.Load() {
+		d.mu.Unlock()
+		lf.Close()
+		return d.logAndReturnError(errShuttingDown, "Refusing to start logging")
 	}
 	d.fileToLogWrapperMap[file] = lf
 	d.containerIdToLogWrapperMap[info.ContainerID] = lf
@@ -103,6 +131,7 @@ func (d *driver) StartLogging(file string, info logger.Info) error {
 }
 
 func (d *driver) consumeLog(lp *logPair) {
+	defer close(lp.done)
 	dec := protoio.NewUint32DelimitedReader(lp.logFile, binary.BigEndian, 1e6)
 	defer dec.Close()
 	defer lp.Close()
@@ -119,10 +148,13 @@ func (d *driver) consumeLog(lp *logPair) {
 		}
 
 		if len(bytes.Fields(buf.Line)) > 0 {
+			lp.mu.RLock()
 			if err := lp.gLogger.Log(createMessageFromBuffer(&buf)); err != nil {
 				d.sLog.With("id", lp.info.ContainerID, "error", err, "message", buf).Error("error writing log to GCP logger message")
 			}
-			if lp.info.Config[localLoggingConfig] == "true" {
+			localLogging := lp.info.Config[localLoggingConfig] == "true"
+			lp.mu.RUnlock()
+			if localLogging {
 				if err := lp.jsonl.Log(createMessageFromBuffer(&buf)); err != nil {
 					d.sLog.With("id", lp.info.ContainerID, "error", err, "message", buf).Error("error writing log message to JSON logger")
 				}
@@ -150,40 +182,115 @@ func createMessageFromBuffer(buf *logdriver.LogEntry) *logger.Message {
 	return &msg
 }
 
-func (d *driver) StopLogging(file string) (err error) {
+// StopLogging stops tracking the container and returns right away. Its remaining entries are flushed in the
+// background, within the flush-timeout of the container
+func (d *driver) StopLogging(file string) error {
 	d.sLog.With("file", file).Debug("Stopping logging")
 	d.mu.Lock()
 	lf, ok := d.fileToLogWrapperMap[file]
 	if ok {
-		err = lf.gLogger.(*nGCPLogger).logger.Flush()
-		if err != nil {
-			d.sLog.With("error", err).Error("Error flushing GCP logger during shutdown")
-		}
-		err = lf.logFile.Close()
-		if err != nil {
-			d.sLog.With("error", err).Error("Error closing log file")
-		}
 		delete(d.fileToLogWrapperMap, file)
+		// The container may have been started again already, with a new pair
+		if d.containerIdToLogWrapperMap[lf.info.ContainerID] == lf {
+			delete(d.containerIdToLogWrapperMap, lf.info.ContainerID)
+		}
+		d.stopping[lf] = struct{}{}
 	}
 	d.mu.Unlock()
-	return err
+	if ok {
+		go d.stopLogPair(lf)
+	}
+	return nil
 }
 
+// stopLogPair drains and closes the pair, aborting the writes of its logger still in progress once the flush-timeout
+// of the container expired
+func (d *driver) stopLogPair(lp *logPair) {
+	timeout := lp.flushTimeout()
+	stopped := make(chan struct{})
+	go func() {
+		lp.drain(time.Now().Add(timeout))
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		d.sLog.With("id", lp.info.ContainerID).Debug("Stopped logging")
+	case <-time.After(timeout):
+		d.sLog.With("id", lp.info.ContainerID, "timeout", timeout).Warn("Flushing the logger of a stopped container timed out, aborting its writes")
+		lp.logger().abort()
+		<-stopped
+	}
+	d.mu.Lock()
+	delete(d.stopping, lp)
+	d.mu.Unlock()
+}
+
+// containerHealth is the state of the sinks of a container reported by the health endpoint
+type containerHealth struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Sinks     []sinkHealth   `json:"sinks"`
+	Oversized *oversizeStats `json:"oversized,omitempty"`
+	Losses    []lossCount    `json:"losses,omitempty"`
+}
+
+// Health returns the state of the sinks of every container being logged
+func (d *driver) Health() []containerHealth {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	containers := make([]containerHealth, 0, len(d.fileToLogWrapperMap))
+	for _, lf := range d.fileToLogWrapperMap {
+		l := lf.logger()
+		h := containerHealth{
+			ID:     lf.info.ContainerID,
+			Name:   lf.info.ContainerName,
+			Sinks:  l.health(),
+			Losses: l.losses.snapshot(),
+		}
+		if l.oversize != nil {
+			stats := l.oversize.snapshot()
+			h.Oversized = &stats
+		}
+		containers = append(containers, h)
+	}
+	return containers
+}
+
+// ReadLogs reads the local log file of a container. The file of a stopped container is opened on its own, so its logs
+// can still be read
 func (d *driver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCloser, error) {
 	d.mu.Lock()
 	lf, exists := d.containerIdToLogWrapperMap[info.ContainerID]
 	d.mu.Unlock()
-	if !exists {
-		return nil, fmt.Errorf("logger does not exist for %s", info.ContainerID)
+
+	var jsonl logger.Logger
+	closeJsonl := func() {}
+	if exists {
+		jsonl = lf.jsonl
+	} else {
+		if info.LogPath == "" {
+			info.LogPath = filepath.Join("/var/log/docker", info.ContainerID)
+		}
+		if _, err := os.Stat(info.LogPath); err != nil {
+			return nil, fmt.Errorf("logger does not exist for %s: %w", info.ContainerID, err)
+		}
+		l, err := jsonfilelog.New(info)
+		if err != nil {
+			return nil, fmt.Errorf("error opening the logs of %s: %w", info.ContainerID, err)
+		}
+		jsonl = l
+		closeJsonl = func() { l.Close() }
 	}
 
 	r, w := io.Pipe()
-	lr, ok := lf.jsonl.(logger.LogReader)
+	lr, ok := jsonl.(logger.LogReader)
 	if !ok {
+		closeJsonl()
 		return nil, fmt.Errorf("logger does not support reading")
 	}
 
 	go func() {
+		defer closeJsonl()
 		watcher := lr.ReadLogs(config)
 
 		enc := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
@@ -0,0 +1,1114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"github.com/containerd/fifo"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-plugins-helpers/sdk"
+	protoio "github.com/gogo/protobuf/io"
+	ltype "google.golang.org/genproto/googleapis/logging/type"
+	"google.golang.org/protobuf/proto"
+
+	"dgcplogs/internal/fakelogging"
+)
+
+const testProject = "test-project"
+
+// testHarness runs the plugin handlers on a unix socket, with the containers configured to log to a fake Cloud
+// Logging server, and drives them like the docker daemon does
+type testHarness struct {
+	server *fakelogging.Server
+	driver *driver
+	dir    string
+	client *http.Client
+}
+
+func newTestHarness(t *testing.T) *testHarness {
+	t.Helper()
+	server, err := fakelogging.Start()
+	if err != nil {
+		t.Fatalf("error starting fake logging server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	prevBufferDir := bufferDir
+	bufferDir = filepath.Join(dir, "buffer")
+	t.Cleanup(func() { bufferDir = prevBufferDir })
+	socket := filepath.Join(dir, "ngcplogs.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("error listening on plugin socket: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	d := createDriver()
+	h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
+	registerHandlers(&h, d)
+	go h.Serve(l)
+
+	return &testHarness{
+		server: server,
+		driver: d,
+		dir:    dir,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+func (h *testHarness) call(t *testing.T, endpoint string, req any) {
+	t.Helper()
+	if err := h.tryCall(t, endpoint, req); err != "" {
+		t.Fatalf("%s failed: %s", endpoint, err)
+	}
+}
+
+// tryCall calls the endpoint, returning the error it responded with
+func (h *testHarness) tryCall(t *testing.T, endpoint string, req any) string {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := h.client.Post("http://plugin/LogDriver."+endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("error calling %s: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	var res response
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("error decoding %s response: %v", endpoint, err)
+	}
+	return res.Err
+}
+
+// runContainer starts logging for a container, writes the lines through the FIFO in the protobuf framing used by
+// the docker daemon, and stops logging once they have been consumed
+func (h *testHarness) runContainer(t *testing.T, info logger.Info, lines ...string) {
+	t.Helper()
+	file := h.startContainer(t, info, lines...)
+	h.waitForEntriesOf(t, info.ContainerID, len(lines))
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+}
+
+// startContainer starts logging for a container and writes the lines through its FIFO, returning the FIFO path
+func (h *testHarness) startContainer(t *testing.T, info logger.Info, lines ...string) string {
+	t.Helper()
+	file, w := h.openContainer(t, info)
+	w.write(t, lines...)
+	w.Close()
+	return file
+}
+
+// containerWriter writes lines to the FIFO of a container in the protobuf framing used by the docker daemon
+type containerWriter struct {
+	io.WriteCloser
+	enc   protoio.WriteCloser
+	lines int
+}
+
+func (w *containerWriter) write(t *testing.T, lines ...string) {
+	t.Helper()
+	ts := time.Date(2024, 3, 15, 11, 21, 40, 0, time.UTC)
+	for _, line := range lines {
+		err := w.enc.WriteMsg(&logdriver.LogEntry{
+			Source:   "stdout",
+			TimeNano: ts.Add(time.Duration(w.lines) * time.Second).UnixNano(),
+			Line:     []byte(line),
+		})
+		if err != nil {
+			t.Fatalf("error writing log line: %v", err)
+		}
+		w.lines++
+	}
+}
+
+// openContainer starts logging for a container, returning the FIFO path and a writer to it
+func (h *testHarness) openContainer(t *testing.T, info logger.Info) (string, *containerWriter) {
+	t.Helper()
+	file := filepath.Join(h.dir, info.ContainerID+".fifo")
+	info.LogPath = filepath.Join(h.dir, info.ContainerID+".json")
+	if _, found := info.Config[endpointKey]; !found {
+		info.Config[endpointKey] = h.server.Addr()
+	}
+	info.Config[insecureKey] = "true"
+
+	w, err := fifo.OpenFifo(context.Background(), file, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_NONBLOCK, 0700)
+	if err != nil {
+		t.Fatalf("error creating fifo: %v", err)
+	}
+	h.call(t, "StartLogging", StartLoggingRequest{File: file, Info: info})
+	return file, &containerWriter{WriteCloser: w, enc: protoio.NewUint32DelimitedWriter(w, binary.BigEndian)}
+}
+
+// waitForEntriesOf waits until at least n entries of the container have been written
+func (h *testHarness) waitForEntriesOf(t *testing.T, containerID string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(h.entriesOf(containerID)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d entries of %s, got %d", n, containerID, len(h.entriesOf(containerID)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (h *testHarness) entriesOf(containerID string) []*loggingpb.LogEntry {
+	var entries []*loggingpb.LogEntry
+	for _, e := range h.server.Entries(defaultLogName) {
+		container := e.GetJsonPayload().GetFields()["container"].GetStructValue()
+		if container.GetFields()["id"].GetStringValue() == containerID {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func TestStartLoggingWritesEntries(t *testing.T) {
+	h := newTestHarness(t)
+
+	h.runContainer(t, logger.Info{
+		ContainerID:   "json-container",
+		ContainerName: "/sample-app",
+		Config: map[string]string{
+			projectOptKey: testProject,
+			"extract-gcp": "true",
+		},
+	},
+		`{"level":"warn","msg":"disk almost full","logging.googleapis.com/labels":{"team":"payments"}}`,
+		`plain text line`,
+	)
+
+	entries := h.entriesOf("json-container")
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	jsonEntry := entries[0]
+	if got, want := jsonEntry.LogName, "projects/"+testProject+"/logs/"+defaultLogName; got != want {
+		t.Errorf("log name = %q, want %q", got, want)
+	}
+	if jsonEntry.Severity != ltype.LogSeverity_WARNING {
+		t.Errorf("severity = %v, want WARNING", jsonEntry.Severity)
+	}
+	fields := jsonEntry.GetJsonPayload().GetFields()
+	if got := fields["message"].GetStringValue(); got != "disk almost full" {
+		t.Errorf("message = %q, want the extracted msg", got)
+	}
+	if _, found := fields["level"]; found {
+		t.Errorf("level should have been removed from the payload")
+	}
+	if got := jsonEntry.Labels["team"]; got != "payments" {
+		t.Errorf("team label = %q, want payments", got)
+	}
+	if got := fields["container"].GetStructValue().GetFields()["name"].GetStringValue(); got != "/sample-app" {
+		t.Errorf("container name = %q, want /sample-app", got)
+	}
+
+	textEntry := entries[1]
+	if textEntry.Severity != ltype.LogSeverity_DEFAULT {
+		t.Errorf("severity = %v, want DEFAULT", textEntry.Severity)
+	}
+	if got := textEntry.GetJsonPayload().GetFields()["message"].GetStringValue(); got != "plain text line" {
+		t.Errorf("message = %q, want the raw line", got)
+	}
+	if !textEntry.Timestamp.AsTime().Equal(time.Date(2024, 3, 15, 11, 21, 41, 0, time.UTC)) {
+		t.Errorf("timestamp = %v, want the docker timestamp", textEntry.Timestamp.AsTime())
+	}
+}
+
+func TestPluginSettingsAreDefaults(t *testing.T) {
+	t.Setenv(projectOptKey, "plugin-project")
+	h := newTestHarness(t)
+
+	files := []string{
+		h.startContainer(t, logger.Info{ContainerID: "default-container", Config: map[string]string{}}, "from plugin settings"),
+		h.startContainer(t, logger.Info{
+			ContainerID: "override-container",
+			Config:      map[string]string{projectOptKey: testProject},
+		}, "from log-opts"),
+	}
+	h.waitForEntriesOf(t, "default-container", 1)
+	h.waitForEntriesOf(t, "override-container", 1)
+	for _, file := range files {
+		h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	}
+
+	for id, project := range map[string]string{"default-container": "plugin-project", "override-container": testProject} {
+		entries := h.entriesOf(id)
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 entry for %s, got %d", id, len(entries))
+		}
+		if got, want := entries[0].LogName, "projects/"+project+"/logs/"+defaultLogName; got != want {
+			t.Errorf("log name of %s = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestConfigFileProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+profiles:
+  payments:
+    options:
+      gcp-project: payments-prod
+  plain:
+    options:
+      gcp-project: plain-project
+      extract-json-message: false
+rules:
+  - image: registry.example.com/payments/*
+    labels:
+      tier: backend
+    profile: payments
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseConfigFile(path)
+	if err != nil {
+		t.Fatalf("error parsing config file: %v", err)
+	}
+	hostConfig.Store(c)
+	t.Cleanup(func() { hostConfig.Store(nil) })
+	h := newTestHarness(t)
+
+	h.runContainer(t, logger.Info{
+		ContainerID:        "matched-container",
+		ContainerImageName: "registry.example.com/payments/api:1.2",
+		ContainerLabels:    map[string]string{"tier": "backend"},
+		Config:             map[string]string{},
+	}, "matched by a rule")
+	h.runContainer(t, logger.Info{
+		ContainerID: "selected-container",
+		Config:      map[string]string{profileKey: "plain"},
+	}, `{"message":"kept as text"}`)
+
+	matched := h.entriesOf("matched-container")
+	if len(matched) != 1 || matched[0].LogName != "projects/payments-prod/logs/"+defaultLogName {
+		t.Errorf("expected 1 entry in payments-prod for the matched container, got %v", matched)
+	}
+	selected := h.entriesOf("selected-container")
+	if len(selected) != 1 || selected[0].LogName != "projects/plain-project/logs/"+defaultLogName {
+		t.Fatalf("expected 1 entry in plain-project for the selected container, got %v", selected)
+	}
+	if got := selected[0].GetJsonPayload().GetFields()["message"].GetStringValue(); got != `{"message":"kept as text"}` {
+		t.Errorf("message = %q, want the raw line since the profile disables extract-json-message", got)
+	}
+}
+
+func TestConfigFileValidation(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown option":  "profiles:\n  p:\n    options:\n      extract-severty: false\n",
+		"unknown profile": "rules:\n  - name: web-*\n    profile: missing\n",
+		"unknown field":   "profiles:\n  p:\n    option:\n      gcp-project: p\n",
+		"empty rule":      "profiles:\n  p: {}\nrules:\n  - profile: p\n",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseConfigFile(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestStartLoggingAcceptsDaemonLogOpts(t *testing.T) {
+	h := newTestHarness(t)
+
+	h.runContainer(t, logger.Info{
+		ContainerID: "non-blocking-container",
+		Config: map[string]string{
+			projectOptKey:     testProject,
+			"mode":            "non-blocking",
+			"max-buffer-size": "4m",
+			"max-size":        "10m",
+			"max-file":        "3",
+		},
+	}, "line")
+}
+
+func TestStartLoggingAttachesResource(t *testing.T) {
+	h := newTestHarness(t)
+
+	h.runContainer(t, logger.Info{
+		ContainerID:        "task-container",
+		ContainerName:      "/worker",
+		ContainerImageName: "example/worker",
+		Config: map[string]string{
+			projectOptKey:        testProject,
+			resourceTypeKey:      resourceTypeGenericTask,
+			resourceLocationKey:  "eu-west",
+			resourceNamespaceKey: "on-prem",
+		},
+	}, `{"severity":"ERROR","message":"job failed"}`)
+
+	entries := h.entriesOf("task-container")
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	resource := entries[0].Resource
+	if resource.GetType() != resourceTypeGenericTask {
+		t.Fatalf("resource type = %q, want %s", resource.GetType(), resourceTypeGenericTask)
+	}
+	want := map[string]string{
+		"location":  "eu-west",
+		"namespace": "on-prem",
+		"job":       "example/worker",
+		"task_id":   "task-container",
+	}
+	for k, v := range want {
+		if got := resource.Labels[k]; got != v {
+			t.Errorf("resource label %s = %q, want %q", k, got, v)
+		}
+	}
+	if entries[0].Severity != ltype.LogSeverity_ERROR {
+		t.Errorf("severity = %v, want ERROR", entries[0].Severity)
+	}
+}
+
+func TestLazyStartupBuffersUntilConnected(t *testing.T) {
+	h := newTestHarness(t)
+	addr := h.server.Addr()
+	h.server.Close()
+
+	// Cloud Logging is unreachable, which would make StartLogging fail in strict mode. The container keeps running
+	// until it is reachable, since the entries of a container stopped before are discarded
+	file, w := h.openContainer(t, logger.Info{
+		ContainerID:   "lazy-container",
+		ContainerName: "/lazy",
+		Config: map[string]string{
+			projectOptKey:    testProject,
+			endpointKey:      addr,
+			startupModeKey:   startupModeLazy,
+			startupBufferKey: startupBufferDisk,
+		},
+	})
+	w.write(t, `{"severity":"INFO","message":"first"}`, `{"severity":"INFO","message":"second"}`)
+
+	server, err := fakelogging.StartAt(addr)
+	if err != nil {
+		t.Fatalf("error restarting fake logging server: %v", err)
+	}
+	t.Cleanup(server.Close)
+	h.server = server
+
+	if _, err := server.WaitForEntries(defaultLogName, 2, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+
+	entries := h.entriesOf("lazy-container")
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	for i, want := range []string{"first", "second"} {
+		if got := entries[i].GetJsonPayload().GetFields()["message"].GetStringValue(); got != want {
+			t.Errorf("entry %d message = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestOversizedEntries(t *testing.T) {
+	h := newTestHarness(t)
+	message := strings.Repeat("0123456789", 500)
+
+	h.runContainer(t, logger.Info{
+		ContainerID: "truncate-container",
+		Config: map[string]string{
+			projectOptKey:     testProject,
+			maxEntrySizeKey:   "2000",
+			oversizePolicyKey: oversizeTruncate,
+		},
+	}, message)
+
+	entries := h.entriesOf("truncate-container")
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 truncated entry, got %d", len(entries))
+	}
+	if size := proto.Size(entries[0]); size > 2000 {
+		t.Errorf("truncated entry is %d bytes, over the 2000 bytes limit", size)
+	}
+	got := entries[0].GetJsonPayload().GetFields()["message"].GetStringValue()
+	if kept, _, found := strings.Cut(got, "…[truncated "); !found || !strings.HasPrefix(message, kept) {
+		t.Errorf("message = %q, want a prefix of the line with the truncation marker", got)
+	}
+
+	h.runContainer(t, logger.Info{
+		ContainerID: "split-container",
+		Config: map[string]string{
+			projectOptKey:     testProject,
+			maxEntrySizeKey:   "2000",
+			oversizePolicyKey: oversizeSplit,
+		},
+	}, message)
+
+	entries = h.entriesOf("split-container")
+	if len(entries) < 3 {
+		t.Fatalf("expected the entry to be split in at least 3 entries, got %d", len(entries))
+	}
+	var joined strings.Builder
+	for i, e := range entries {
+		if got := e.Labels[splitIndexLabel]; got != strconv.Itoa(i) {
+			t.Errorf("entry %d has split index %q", i, got)
+		}
+		if got := e.Labels[splitTotalLabel]; got != strconv.Itoa(len(entries)) {
+			t.Errorf("entry %d has split total %q, want %d", i, got, len(entries))
+		}
+		if e.Operation.GetId() != entries[0].Operation.GetId() || e.Operation.GetFirst() != (i == 0) || e.Operation.GetLast() != (i == len(entries)-1) {
+			t.Errorf("entry %d has operation %v", i, e.Operation)
+		}
+		joined.WriteString(e.GetJsonPayload().GetFields()["message"].GetStringValue())
+	}
+	if joined.String() != message {
+		t.Errorf("joined split messages don't match the original line")
+	}
+
+	// Lines that fail to parse as JSON are written as text, which is truncated like a message
+	invalid := `{"message": ` + message + `}`
+	file := h.startContainer(t, logger.Info{
+		ContainerID: "invalid-json-container",
+		Config: map[string]string{
+			projectOptKey:     testProject,
+			maxEntrySizeKey:   "2000",
+			oversizePolicyKey: oversizeTruncate,
+		},
+	}, invalid)
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	h.waitForStopped(t, 5*time.Second)
+	var texts []string
+	for _, e := range h.server.Entries(defaultLogName) {
+		if text := e.GetTextPayload(); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	if len(texts) != 1 {
+		t.Fatalf("expected 1 truncated text entry, got %d", len(texts))
+	}
+	if kept, _, found := strings.Cut(texts[0], "…[truncated "); !found || !strings.HasPrefix("Error parsing JSON: "+invalid, kept) {
+		t.Errorf("text = %q, want a prefix of the line with the truncation marker", texts[0])
+	}
+}
+
+func TestLostEntriesAreReported(t *testing.T) {
+	h := newTestHarness(t)
+
+	file := h.startContainer(t, logger.Info{
+		ContainerID: "lossy-container",
+		Config: map[string]string{
+			projectOptKey:     testProject,
+			maxEntrySizeKey:   "2000",
+			oversizePolicyKey: oversizeDrop,
+		},
+	}, strings.Repeat("0123456789", 500), "kept")
+	h.waitForEntriesOf(t, "lossy-container", 1)
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	h.waitForEntriesOf(t, "lossy-container", 2)
+
+	entries := h.entriesOf("lossy-container")
+	if len(entries) != 2 {
+		t.Fatalf("expected the kept entry and the loss report, got %d entries", len(entries))
+	}
+	report := entries[1]
+	if report.Severity != ltype.LogSeverity_WARNING {
+		t.Errorf("loss report severity = %v, want WARNING", report.Severity)
+	}
+	details := report.GetJsonPayload().GetFields()[name].GetStructValue().GetFields()
+	if lost := details["lost"].GetNumberValue(); lost != 1 {
+		t.Errorf("loss report counts %v lost entries, want 1", lost)
+	}
+	losses := details["losses"].GetListValue().GetValues()
+	if len(losses) != 1 || losses[0].GetStructValue().GetFields()["reason"].GetStringValue() != lossOversize {
+		t.Errorf("losses = %v, want a single oversize loss", losses)
+	}
+}
+
+func TestConfigFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(project string) {
+		t.Helper()
+		content := "profiles:\n  web:\n    options:\n      gcp-project: " + project + "\nrules:\n  - name: web-*\n    profile: web\n"
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("before-reload")
+	c, err := parseConfigFile(path)
+	if err != nil {
+		t.Fatalf("error parsing config file: %v", err)
+	}
+	hostConfig.Store(c)
+	t.Cleanup(func() { hostConfig.Store(nil) })
+	h := newTestHarness(t)
+
+	file, w := h.openContainer(t, logger.Info{ContainerID: "reloaded-container", ContainerName: "/web-1", Config: map[string]string{}})
+	w.write(t, "first")
+	h.waitForEntriesOf(t, "reloaded-container", 1)
+
+	writeConfig("after-reload")
+	h.driver.reloadConfig(path)
+	w.write(t, "second")
+	h.waitForEntriesOf(t, "reloaded-container", 2)
+	if got := metricSeriesOf(t, "web-1")[name+"_lines_read_total"]; !slices.Equal(got, []float64{2}) {
+		t.Errorf("expected the lines read series to be kept by the reload, got %v", got)
+	}
+
+	if err := os.WriteFile(path, []byte("profiles: [not, a, map]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.driver.reloadConfig(path)
+	w.write(t, "third")
+	h.waitForEntriesOf(t, "reloaded-container", 3)
+	w.Close()
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+
+	entries := h.entriesOf("reloaded-container")
+	for i, project := range []string{"before-reload", "after-reload", "after-reload"} {
+		if got, want := entries[i].LogName, "projects/"+project+"/logs/"+defaultLogName; got != want {
+			t.Errorf("entry %d log name = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestShutdownFlushesContainers(t *testing.T) {
+	h := newTestHarness(t)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	// The FIFO is left open, as the docker daemon does for running containers
+	_, w := h.openContainer(t, logger.Info{
+		ContainerID: "running-container",
+		Config: map[string]string{
+			projectOptKey:     testProject,
+			delayThresholdKey: "60000",
+		},
+	})
+	defer w.Close()
+	w.write(t, "first", "second", "third")
+
+	if err := h.driver.shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if entries := h.entriesOf("running-container"); len(entries) != 3 {
+		t.Errorf("expected the 3 entries to be flushed, got %d", len(entries))
+	}
+
+	info := logger.Info{ContainerID: "late-container", Config: map[string]string{projectOptKey: testProject}}
+	if err := h.tryCall(t, "StartLogging", StartLoggingRequest{File: filepath.Join(h.dir, "late.fifo"), Info: info}); !strings.Contains(err, errShuttingDown.Error()) {
+		t.Errorf("StartLogging error = %q, want %q", err, errShuttingDown)
+	}
+}
+
+func TestShutdownTimeoutReportsDroppedEntries(t *testing.T) {
+	h := newTestHarness(t)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	_, w := h.openContainer(t, logger.Info{
+		ContainerID: "stuck-container",
+		Config:      map[string]string{projectOptKey: testProject},
+	})
+	defer w.Close()
+	h.server.SetWriteDelay(time.Minute)
+	w.write(t, "first", "second")
+	h.driver.mu.Lock()
+	lp := h.driver.containerIdToLogWrapperMap["stuck-container"]
+	h.driver.mu.Unlock()
+	t.Cleanup(lp.logger().abort)
+
+	err := h.driver.shutdown(500 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "dropping 2 entries") {
+		t.Errorf("shutdown error = %v, want the 2 entries that were not written", err)
+	}
+}
+
+func TestShutdownKeepsDiskBuffers(t *testing.T) {
+	h := newTestHarness(t)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	addr := h.server.Addr()
+	h.server.Close()
+
+	info := logger.Info{
+		ContainerID: "buffered-container",
+		Config: map[string]string{
+			projectOptKey:    testProject,
+			endpointKey:      addr,
+			startupModeKey:   startupModeLazy,
+			startupBufferKey: startupBufferDisk,
+		},
+	}
+	_, w := h.openContainer(t, info)
+	defer w.Close()
+	w.write(t, "first", "second")
+
+	if err := h.driver.shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := filepath.Glob(filepath.Join(bufferDir, "*"+pendingBufferSuffix))
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected 1 kept buffer, got %v (%v)", pending, err)
+	}
+
+	// The next start of the plugin writes the kept entries first
+	shuttingDown.Store(false)
+	dir := bufferDir
+	h = newTestHarness(t)
+	bufferDir = dir
+	info.Config = map[string]string{
+		projectOptKey:    testProject,
+		startupModeKey:   startupModeLazy,
+		startupBufferKey: startupBufferDisk,
+	}
+	file := h.startContainer(t, info, "third")
+	h.waitForEntriesOf(t, "buffered-container", 3)
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+
+	for i, want := range []string{"first", "second", "third"} {
+		if got := h.entriesOf("buffered-container")[i].GetJsonPayload().GetFields()["message"].GetStringValue(); got != want {
+			t.Errorf("entry %d message = %q, want %q", i, got, want)
+		}
+	}
+	if pending, _ := filepath.Glob(filepath.Join(dir, "*"+pendingBufferSuffix)); len(pending) != 0 {
+		t.Errorf("expected the kept buffer to be removed, got %v", pending)
+	}
+}
+
+// waitForStopped waits until the containers stopped with StopLogging are flushed
+func (h *testHarness) waitForStopped(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		h.driver.mu.Lock()
+		stopping := len(h.driver.stopping)
+		h.driver.mu.Unlock()
+		if stopping == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d stopped containers to be flushed", stopping)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStopLoggingCleansUpRestartedContainers(t *testing.T) {
+	h := newTestHarness(t)
+	info := logger.Info{ContainerID: "restarted-container", Config: map[string]string{projectOptKey: testProject}}
+
+	h.runContainer(t, info, "before restart")
+	h.waitForStopped(t, 5*time.Second)
+	h.runContainer(t, info, "after restart")
+	h.waitForStopped(t, 5*time.Second)
+
+	if entries := h.entriesOf("restarted-container"); len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(entries))
+	}
+	h.driver.mu.Lock()
+	defer h.driver.mu.Unlock()
+	if len(h.driver.fileToLogWrapperMap) != 0 || len(h.driver.containerIdToLogWrapperMap) != 0 {
+		t.Errorf("expected the stopped container to be removed, got %d files and %d containers",
+			len(h.driver.fileToLogWrapperMap), len(h.driver.containerIdToLogWrapperMap))
+	}
+}
+
+func TestStopLoggingAbortsAfterFlushTimeout(t *testing.T) {
+	h := newTestHarness(t)
+
+	file, w := h.openContainer(t, logger.Info{
+		ContainerID: "slow-container",
+		Config: map[string]string{
+			projectOptKey:      testProject,
+			flushTimeoutConfig: "200",
+		},
+	})
+	h.server.SetWriteDelay(time.Minute)
+	w.write(t, "never written")
+	w.Close()
+
+	start := time.Now()
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("StopLogging took %s, it should not wait for the flush", elapsed)
+	}
+	h.waitForStopped(t, 5*time.Second)
+	if entries := h.entriesOf("slow-container"); len(entries) != 0 {
+		t.Errorf("expected the write to be aborted, got %d entries", len(entries))
+	}
+}
+
+func TestStopLoggingAbortsBatchSinkRetries(t *testing.T) {
+	h := newTestHarness(t)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer webhook.Close()
+
+	file := h.startContainer(t, logger.Info{
+		ContainerID: "retrying-container",
+		Config: map[string]string{
+			sinksKey:             webhookSinkKind,
+			webhookURLKey:        webhook.URL,
+			webhookMaxRetriesKey: "10",
+			flushTimeoutConfig:   "200",
+		},
+	}, "never delivered")
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	h.waitForStopped(t, 2*time.Second)
+}
+
+func TestStartLoggingReleasesLoggerOnError(t *testing.T) {
+	h := newTestHarness(t)
+	info := logger.Info{
+		ContainerID: "missing-fifo-container",
+		Config: map[string]string{
+			projectOptKey: testProject,
+			endpointKey:   h.server.Addr(),
+			insecureKey:   "true",
+		},
+		LogPath: filepath.Join(h.dir, "missing-fifo-container.json"),
+	}
+	if err := h.tryCall(t, "StartLogging", StartLoggingRequest{File: filepath.Join(h.dir, "missing.fifo"), Info: info}); err == "" {
+		t.Fatal("expected an error opening a missing FIFO")
+	}
+	connPool.mu.Lock()
+	defer connPool.mu.Unlock()
+	if len(connPool.conns) != 0 {
+		t.Errorf("expected the connection of the logger to be released, got %d pooled connections", len(connPool.conns))
+	}
+}
+
+func TestContainerCredentialsOverrideDefaults(t *testing.T) {
+	t.Setenv(credentialsProfileKey, "plugin-profile")
+	t.Setenv(impersonateKey, "plugin@test-project.iam.gserviceaccount.com")
+	t.Setenv(projectOptKey, "plugin-project")
+	prev := hostConfig.Load()
+	t.Cleanup(func() { hostConfig.Store(prev) })
+	hostConfig.Store(&configFile{
+		Profiles: map[string]profile{
+			"payments": {Options: map[string]string{clientCredentialsJSON: `{"type": "service_account"}`}},
+		},
+	})
+
+	for name, tc := range map[string]struct {
+		config map[string]string
+		want   map[string]string
+	}{
+		"plugin settings": {
+			config: map[string]string{},
+			want: map[string]string{
+				credentialsProfileKey: "plugin-profile",
+				impersonateKey:        "plugin@test-project.iam.gserviceaccount.com",
+			},
+		},
+		"profile": {
+			config: map[string]string{profileKey: "payments"},
+			want:   map[string]string{clientCredentialsJSON: `{"type": "service_account"}`},
+		},
+		"container": {
+			config: map[string]string{profileKey: "payments", clientCredentialsFile: "/etc/gcp/app.json"},
+			want:   map[string]string{clientCredentialsFile: "/etc/gcp/app.json"},
+		},
+	} {
+		cfg, err := resolveOptions(logger.Info{ContainerID: "c", Config: tc.config})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := cfg[projectOptKey]; got != "plugin-project" {
+			t.Errorf("%s: project = %q, want the plugin setting", name, got)
+		}
+		got := make(map[string]string)
+		for _, k := range credentialsOptions {
+			if v, found := cfg[k]; found {
+				got[k] = v
+			}
+		}
+		if !maps.Equal(got, tc.want) {
+			t.Errorf("%s: credentials options = %v, want %v", name, got, tc.want)
+		}
+	}
+}
+
+// pooledConnsTo returns the pooled connections to the endpoint, with the number of clients using each
+func pooledConnsTo(endpoint string) []int {
+	connPool.mu.Lock()
+	defer connPool.mu.Unlock()
+	var refs []int
+	for key, pc := range connPool.conns {
+		if strings.Contains(key.endpoint, endpoint) {
+			refs = append(refs, pc.refs)
+		}
+	}
+	return refs
+}
+
+func TestContainersShareConnections(t *testing.T) {
+	h := newTestHarness(t)
+
+	var files []string
+	for _, id := range []string{"first-container", "second-container"} {
+		file, w := h.openContainer(t, logger.Info{ContainerID: id, Config: map[string]string{projectOptKey: testProject}})
+		defer w.Close()
+		w.write(t, "from "+id)
+		files = append(files, file)
+	}
+	h.waitForEntriesOf(t, "first-container", 1)
+	h.waitForEntriesOf(t, "second-container", 1)
+	if refs := pooledConnsTo(h.server.Addr()); !slices.Equal(refs, []int{2}) {
+		t.Fatalf("expected 1 connection used by both containers, got %v", refs)
+	}
+
+	h.call(t, "StopLogging", StopLoggingRequest{File: files[0]})
+	h.waitForStopped(t, 5*time.Second)
+	if refs := pooledConnsTo(h.server.Addr()); !slices.Equal(refs, []int{1}) {
+		t.Fatalf("expected the connection to be kept for the running container, got %v", refs)
+	}
+	h.call(t, "StopLogging", StopLoggingRequest{File: files[1]})
+	h.waitForStopped(t, 5*time.Second)
+	if refs := pooledConnsTo(h.server.Addr()); len(refs) != 0 {
+		t.Errorf("expected the connection to be closed with the last container, got %v", refs)
+	}
+}
+
+// metricSeriesOf returns the values of the series of the container by metric, the sample count for histograms
+func metricSeriesOf(t *testing.T, containerName string) map[string][]float64 {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %v", err)
+	}
+	series := make(map[string][]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "container_name" && l.GetValue() == containerName {
+					v := m.GetCounter().GetValue() + m.GetGauge().GetValue() + float64(m.GetHistogram().GetSampleCount())
+					series[f.GetName()] = append(series[f.GetName()], v)
+				}
+			}
+		}
+	}
+	return series
+}
+
+func TestRoutesAndMirrors(t *testing.T) {
+	h := newTestHarness(t)
+	config := func() map[string]string {
+		return map[string]string{
+			projectOptKey:         testProject,
+			routesKey:             "team=payments:payments-prod/payments-logs;team=search:search-prod",
+			mirrorDestinationsKey: "archive-project/archive",
+		}
+	}
+
+	for id, team := range map[string]string{"payments-container": "payments", "other-container": "growth"} {
+		file := h.startContainer(t, logger.Info{
+			ContainerID:     id,
+			ContainerLabels: map[string]string{"team": team},
+			Config:          config(),
+		}, "from "+id)
+		h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	}
+	h.waitForStopped(t, 5*time.Second)
+
+	logNames := func(logID string) map[string][]string {
+		names := make(map[string][]string)
+		for _, e := range h.server.Entries(logID) {
+			id := e.GetJsonPayload().GetFields()["container"].GetStructValue().GetFields()["id"].GetStringValue()
+			names[id] = append(names[id], e.LogName)
+		}
+		return names
+	}
+	routed := logNames("payments-logs")
+	if got := routed["payments-container"]; !slices.Equal(got, []string{"projects/payments-prod/logs/payments-logs"}) {
+		t.Errorf("routed entries = %v, want them in payments-prod", got)
+	}
+	if got := logNames(defaultLogName)["other-container"]; !slices.Equal(got, []string{"projects/" + testProject + "/logs/" + defaultLogName}) {
+		t.Errorf("entries of the unmatched container = %v, want them in %s", got, testProject)
+	}
+	archived := logNames("archive")
+	for _, id := range []string{"payments-container", "other-container"} {
+		if got := archived[id]; !slices.Equal(got, []string{"projects/archive-project/logs/archive"}) {
+			t.Errorf("mirrored entries of %s = %v, want them in archive-project", id, got)
+		}
+	}
+}
+
+func TestStopLoggingDeletesMetrics(t *testing.T) {
+	h := newTestHarness(t)
+	webhook := newCaptureServer(t, alwaysOK)
+
+	file, w := h.openContainer(t, logger.Info{
+		ContainerID:   "measured-container",
+		ContainerName: "/measured",
+		Config: map[string]string{
+			projectOptKey:       testProject,
+			sinksKey:            gcpSinkKind + "," + webhookSinkKind,
+			webhookURLKey:       webhook.URL,
+			webhookBatchSizeKey: "1",
+			maxEntrySizeKey:     "2000",
+			oversizePolicyKey:   oversizeDrop,
+		},
+	})
+	w.write(t, "kept", `{"broken": }`, strings.Repeat("0123456789", 500))
+	// Cloud Logging gets the 2 entries under its size limit, the webhook gets all 3
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if sent := metricSeriesOf(t, "measured")[name+"_entries_sent_total"]; len(sent) == 2 && sent[0]+sent[1] == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for both destinations to write, got %v", metricSeriesOf(t, "measured"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	series := metricSeriesOf(t, "measured")
+	for _, metric := range []string{
+		"lines_read_total",
+		"parse_errors_total",
+		"entries_sent_total",
+		"bytes_sent_total",
+		"entries_lost_total",
+		"queue_depth",
+		"write_duration_seconds",
+	} {
+		if _, found := series[name+"_"+metric]; !found {
+			t.Errorf("expected a %s series while the container runs, got %v", metric, series)
+		}
+	}
+
+	w.Close()
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	h.waitForStopped(t, 5*time.Second)
+	if series := metricSeriesOf(t, "measured"); len(series) != 0 {
+		t.Errorf("expected the series of the stopped container to be deleted, got %v", series)
+	}
+
+	// A restarted container gets a new logger while the old one is still flushing, under the same labels
+	unavailable := newCaptureServer(t, func(int) int { return http.StatusServiceUnavailable })
+	restarted := logger.Info{
+		ContainerID:   "restarted-container",
+		ContainerName: "/restarted",
+		Config: map[string]string{
+			sinksKey:             webhookSinkKind,
+			webhookURLKey:        unavailable.URL,
+			webhookMaxRetriesKey: "10",
+			flushTimeoutConfig:   "200",
+		},
+	}
+	file, w = h.openContainer(t, restarted)
+	w.write(t, "before the restart")
+	w.Close()
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	file, w = h.openContainer(t, restarted)
+	w.write(t, "after the restart")
+	h.waitForStopped(t, 5*time.Second)
+
+	series = metricSeriesOf(t, "restarted")
+	if got := series[name+"_lines_read_total"]; !slices.Equal(got, []float64{2}) {
+		t.Errorf("lines read by the restarted container = %v, want [2]", got)
+	}
+	if got := series[name+"_queue_depth"]; len(got) != 1 || got[0] < 0 {
+		t.Errorf("queue depth of the restarted container = %v, want a single non-negative series", got)
+	}
+
+	w.Close()
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	h.waitForStopped(t, 5*time.Second)
+	if series := metricSeriesOf(t, "restarted"); len(series) != 0 {
+		t.Errorf("expected the series to be deleted with the last logger of the container, got %v", series)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	h := newTestHarness(t)
+	socket := filepath.Join(h.dir, "diagnostics.sock")
+	t.Setenv(diagnosticsAddressEnv, "unix://"+socket)
+	if err := serveDiagnostics(h.driver); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	get := func(path string, v any) {
+		t.Helper()
+		resp, err := client.Get("http://diagnostics" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("error decoding %s: %v", path, err)
+		}
+	}
+
+	webhook := newCaptureServer(t, alwaysOK)
+	file, w := h.openContainer(t, logger.Info{
+		ContainerID:   "diagnosed-container",
+		ContainerName: "/diagnosed",
+		Config: map[string]string{
+			projectOptKey: testProject,
+			sinksKey:      gcpSinkKind + "," + webhookSinkKind,
+			webhookURLKey: webhook.URL + "/hooks/secret-token",
+		},
+	})
+	defer w.Close()
+
+	var loggers []loggerDiagnostics
+	get("/debug/loggers", &loggers)
+	if len(loggers) != 1 {
+		t.Fatalf("expected the running container, got %+v", loggers)
+	}
+	l := loggers[0]
+	if l.File != file || l.ContainerID != "diagnosed-container" || l.Name != "/diagnosed" {
+		t.Errorf("logger = %+v, want the FIFO and container", l)
+	}
+	if got := l.Config[webhookURLKey]; got != "[redacted]" {
+		t.Errorf("%s = %q, want it redacted", webhookURLKey, got)
+	}
+	if got := l.Config[projectOptKey]; got != testProject {
+		t.Errorf("%s = %q, want %q", projectOptKey, got, testProject)
+	}
+	var states []string
+	for _, s := range l.Sinks {
+		states = append(states, s.State)
+		if strings.Contains(s.Sink, "secret-token") {
+			t.Errorf("sink %q exposes the path of %s", s.Sink, webhookURLKey)
+		}
+	}
+	if !slices.Equal(states, []string{sinkStateRunning, sinkStateRunning}) {
+		t.Errorf("sink states = %v, want both sinks running", l.Sinks)
+	}
+
+	var vars map[string]any
+	get("/debug/vars", &vars)
+	if vars["containers"] != 1.0 || vars["stopping"] != 0.0 {
+		t.Errorf("containers = %v and stopping = %v, want 1 and 0", vars["containers"], vars["stopping"])
+	}
+}
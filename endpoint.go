@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	endpointKey = "gcp-endpoint"
+	insecureKey = "gcp-insecure"
+	caFileKey   = "gcp-ca-file"
+)
+
+// endpointConfig controls how the clients connect to Cloud Logging, for regional or Private Service Connect
+// endpoints, or emulators
+type endpointConfig struct {
+	endpoint string
+	insecure bool // plaintext connection without authentication, for local emulators
+	caFile   string
+}
+
+func parseEndpointConfig(cfg map[string]string) (endpointConfig, error) {
+	ep := endpointConfig{
+		endpoint: cfg[endpointKey],
+		caFile:   cfg[caFileKey],
+	}
+	switch cfg[insecureKey] {
+	case "", "false":
+	case "true":
+		ep.insecure = true
+	default:
+		return ep, fmt.Errorf("%s must be true or false, got %q", insecureKey, cfg[insecureKey])
+	}
+	if ep.insecure && ep.caFile != "" {
+		return ep, fmt.Errorf("%s and %s can't be used together", insecureKey, caFileKey)
+	}
+	return ep, nil
+}
+
+// String identifies the endpoint configuration, so that clients are only shared between destinations connecting
+// in the same way
+func (ep endpointConfig) String() string {
+	return fmt.Sprintf("%s;%t;%s", ep.endpoint, ep.insecure, ep.caFile)
+}
+
+func (ep endpointConfig) clientOptions() ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if ep.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(ep.endpoint))
+	}
+	if ep.insecure {
+		opts = append(opts,
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		)
+	}
+	if ep.caFile != "" {
+		pem, err := os.ReadFile(path.Join(hostRoot, ep.caFile))
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", caFileKey, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ep.caFile)
+		}
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pool}))))
+	}
+	return opts, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEndpointConfig(t *testing.T) {
+	for name, cfg := range map[string]map[string]string{
+		"invalid insecure":   {insecureKey: "yes"},
+		"insecure with a CA": {insecureKey: "true", caFileKey: "/etc/ssl/ca.pem"},
+	} {
+		if _, err := parseEndpointConfig(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	prevHostRoot := hostRoot
+	hostRoot = t.TempDir()
+	t.Cleanup(func() { hostRoot = prevHostRoot })
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsServer.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	for file, content := range map[string][]byte{"ca.pem": ca, "empty.pem": []byte("not a certificate")} {
+		if err := os.WriteFile(filepath.Join(hostRoot, file), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for caFile, wantErr := range map[string]string{
+		"/ca.pem":      "",
+		"/empty.pem":   "no certificates found",
+		"/missing.pem": "error reading " + caFileKey,
+	} {
+		ep, err := parseEndpointConfig(map[string]string{endpointKey: "eu-logging.example.com:443", caFileKey: caFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := ep.clientOptions()
+		if wantErr == "" {
+			if err != nil || len(opts) != 2 {
+				t.Errorf("%s: expected the endpoint and TLS options, got %d options (%v)", caFile, len(opts), err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: error = %v, want %q", caFile, err, wantErr)
+		}
+	}
+
+	insecure, err := parseEndpointConfig(map[string]string{endpointKey: "localhost:8085", insecureKey: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure, err := parseEndpointConfig(map[string]string{endpointKey: "localhost:8085"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if insecure.String() == secure.String() {
+		t.Errorf("expected the insecure and secure configurations of %s to use different clients", secure.endpoint)
+	}
+}
@@ -80,6 +80,11 @@ func registerHandlers(h *sdk.Handler, d *driver) {
 		wf := ioutils.NewWriteFlusher(w)
 		io.Copy(wf, stream)
 	})
+
+	h.HandleFunc("/ngcplogs.Health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.Health())
+	})
 }
 
 type response struct {
@@ -0,0 +1,142 @@
+// Package fakelogging provides an in-process fake of the Cloud Logging gRPC API, which records the entries written
+// to it so tests can assert on exactly what would have reached Google.
+package fakelogging
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Server is a fake LoggingServiceV2 server listening on a local TCP port
+type Server struct {
+	loggingpb.UnimplementedLoggingServiceV2Server
+
+	listener net.Listener
+	srv      *grpc.Server
+
+	mu         sync.Mutex
+	requests   []*loggingpb.WriteLogEntriesRequest
+	written    chan struct{}
+	writeDelay time.Duration
+}
+
+// Start starts a fake server on a random local port
+func Start() (*Server, error) {
+	return StartAt("127.0.0.1:0")
+}
+
+// StartAt starts a fake server listening on the given address, such as the address of a server that was closed
+func StartAt(addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: l,
+		srv:      grpc.NewServer(),
+		written:  make(chan struct{}, 1),
+	}
+	loggingpb.RegisterLoggingServiceV2Server(s.srv, s)
+	go s.srv.Serve(l)
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server, closing all connections to it
+func (s *Server) Close() {
+	s.srv.Stop()
+}
+
+// SetWriteDelay makes the following writes take d before being recorded, or fail if their context is canceled first
+func (s *Server) SetWriteDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDelay = d
+}
+
+func (s *Server) WriteLogEntries(ctx context.Context, req *loggingpb.WriteLogEntriesRequest) (*loggingpb.WriteLogEntriesResponse, error) {
+	s.mu.Lock()
+	delay := s.writeDelay
+	s.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, proto.Clone(req).(*loggingpb.WriteLogEntriesRequest))
+	s.mu.Unlock()
+
+	select {
+	case s.written <- struct{}{}:
+	default:
+	}
+	return &loggingpb.WriteLogEntriesResponse{}, nil
+}
+
+// Requests returns all the WriteLogEntries requests received so far
+func (s *Server) Requests() []*loggingpb.WriteLogEntriesRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*loggingpb.WriteLogEntriesRequest(nil), s.requests...)
+}
+
+// Entries returns the entries written to the given log ID, such as ngcplogs-docker-driver, across all projects.
+// The log name, resource and labels set at the request level are merged into each entry, like Cloud Logging does
+func (s *Server) Entries(logID string) []*loggingpb.LogEntry {
+	var entries []*loggingpb.LogEntry
+	for _, req := range s.Requests() {
+		for _, e := range req.Entries {
+			entry := proto.Clone(e).(*loggingpb.LogEntry)
+			if entry.LogName == "" {
+				entry.LogName = req.LogName
+			}
+			if entry.Resource == nil {
+				entry.Resource = req.Resource
+			}
+			for k, v := range req.Labels {
+				if entry.Labels == nil {
+					entry.Labels = make(map[string]string)
+				}
+				if _, found := entry.Labels[k]; !found {
+					entry.Labels[k] = v
+				}
+			}
+			if strings.HasSuffix(entry.LogName, "/logs/"+logID) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// WaitForEntries waits until at least n entries have been written to the given log ID, returning them
+func (s *Server) WaitForEntries(logID string, n int, timeout time.Duration) ([]*loggingpb.LogEntry, error) {
+	deadline := time.After(timeout)
+	for {
+		entries := s.Entries(logID)
+		if len(entries) >= n {
+			return entries, nil
+		}
+		select {
+		case <-s.written:
+		case <-deadline:
+			return entries, fmt.Errorf("timed out waiting for %d entries in %s, got %d", n, logID, len(entries))
+		}
+	}
+}
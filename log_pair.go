@@ -1,19 +1,96 @@
 package main
 
 import (
-	"github.com/docker/docker/daemon/logger"
 	"io"
+	"log/slog"
+	"maps"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
 )
 
 type logPair struct {
 	jsonl   logger.Logger
-	gLogger logger.Logger
 	logFile io.ReadCloser
 	info    logger.Info
+	// rawConfig is the log-opts of the container, before the plugin settings and profiles are applied to them
+	rawConfig map[string]string
+	// done is closed once consumeLog returned, after closing the pair
+	done chan struct{}
+
+	// mu guards the logger and info.Config, which are replaced when the configuration is reloaded
+	mu      sync.RWMutex
+	gLogger logger.Logger
+	closed  bool
 }
 
 func (lp *logPair) Close() {
 	lp.logFile.Close()
-	lp.gLogger.Close()
+	// The logger isn't replaced once closed is set, so it is closed without holding the lock, which could take as
+	// long as the flush-timeout of the container
+	lp.mu.Lock()
+	lp.closed = true
+	gLogger := lp.gLogger
+	lp.mu.Unlock()
+	gLogger.Close()
 	lp.jsonl.Close()
 }
+
+// logger returns the current logger of the pair
+func (lp *logPair) logger() *nGCPLogger {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+	return lp.gLogger.(*nGCPLogger)
+}
+
+// config returns the current options of the pair
+func (lp *logPair) config() map[string]string {
+	lp.mu.RLock()
+	defer lp.mu.RUnlock()
+	return lp.info.Config
+}
+
+// flushTimeout returns how long the logger of the pair is given to write its entries once the container stopped
+func (lp *logPair) flushTimeout() time.Duration {
+	v, found := lp.config()[flushTimeoutConfig]
+	if !found {
+		return defaultFlushTimeout
+	}
+	timeout, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || timeout <= 0 {
+		return defaultFlushTimeout
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// reload replaces the logger of the pair by one created with the given options, if they changed. The current
+// logger is kept if the new one can't be created, and closed once replaced, so it flushes its entries
+func (lp *logPair) reload(cfg map[string]string) (changed bool, err error) {
+	if maps.Equal(cfg, lp.config()) {
+		return false, nil
+	}
+	info := lp.info
+	info.Config = cfg
+	gLogger, err := New(info)
+	if err != nil {
+		return false, err
+	}
+
+	lp.mu.Lock()
+	if lp.closed {
+		lp.mu.Unlock()
+		return false, gLogger.Close()
+	}
+	old := lp.gLogger.(*nGCPLogger)
+	lp.gLogger = gLogger
+	lp.info.Config = cfg
+	lp.mu.Unlock()
+
+	// The series of the container are kept, since the new logger uses them
+	if err := old.Close(); err != nil {
+		slog.Error("error closing the replaced logger", "id", lp.info.ContainerID, "error", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/logging"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	lokiURLKey           = "loki-url"
+	lokiEncodingKey      = "loki-encoding"
+	lokiLabelsKey        = "loki-labels"
+	lokiTenantIDKey      = "loki-tenant-id"
+	lokiBatchSizeKey     = "loki-batch-size"
+	lokiFlushIntervalKey = "loki-flush-interval"
+	lokiMaxRetriesKey    = "loki-max-retries"
+
+	lokiEncodingProtobuf = "protobuf"
+	lokiEncodingJSON     = "json"
+
+	lokiPushPath = "/loki/api/v1/push"
+
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// lokiSink pushes entries to the Loki push API, with the processed JSON payload as the line
+type lokiSink struct {
+	*batchSink
+	url      string
+	encoding string
+	tenantID string
+	labels   map[string]string
+	client   *http.Client
+}
+
+// lokiStream is a set of entries sharing the same labels
+type lokiStream struct {
+	labels  map[string]string
+	entries []logging.Entry
+}
+
+func newLokiSink(ctx context.Context, info logger.Info, data templateData) (*lokiSink, error) {
+	rawURL := info.Config[lokiURLKey]
+	if rawURL == "" {
+		return nil, errors.New(lokiURLKey + " is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", lokiURLKey, err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = lokiPushPath
+	}
+
+	encoding := info.Config[lokiEncodingKey]
+	switch encoding {
+	case "":
+		encoding = lokiEncodingProtobuf
+	case lokiEncodingProtobuf, lokiEncodingJSON:
+	default:
+		return nil, fmt.Errorf("unsupported %s %q, must be %s or %s", lokiEncodingKey, encoding, lokiEncodingProtobuf, lokiEncodingJSON)
+	}
+
+	labels, err := parseKeyValues(info.Config[lokiLabelsKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", lokiLabelsKey, err)
+	}
+	if data.Container != nil {
+		labels["container_name"] = strings.TrimPrefix(data.Container.Name, "/")
+	}
+	if service := info.ContainerLabels[composeServiceLabel]; service != "" {
+		labels["compose_service"] = service
+	}
+	if data.Hostname != "" {
+		labels["host"] = data.Hostname
+	}
+
+	opts, err := parseBatchOptions(info.Config, lokiSinkKind)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &lokiSink{
+		url:      u.String(),
+		encoding: encoding,
+		tenantID: info.Config[lokiTenantIDKey],
+		labels:   labels,
+		client:   &http.Client{},
+	}
+	s.batchSink = newBatchSink(ctx, lokiSinkKind+":"+redactURL(s.url), opts, s.send)
+	return s, nil
+}
+
+func (s *lokiSink) send(ctx context.Context, batch []logging.Entry) error {
+	streams := s.streams(batch)
+
+	var body []byte
+	var contentType string
+	var err error
+	if s.encoding == lokiEncodingJSON {
+		contentType = "application/json"
+		body, err = encodeLokiJSON(streams)
+	} else {
+		contentType = "application/x-protobuf"
+		body, err = encodeLokiProtobuf(streams)
+		body = snappy.Encode(nil, body)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.tenantID)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return retryableError{redactRequestError(err)}
+	}
+	defer resp.Body.Close()
+	return checkHTTPResponse(resp)
+}
+
+// streams groups the entries of the batch by their severity, which is the only label that changes between the
+// entries of a container
+func (s *lokiSink) streams(batch []logging.Entry) []*lokiStream {
+	bySeverity := make(map[logging.Severity]*lokiStream)
+	var streams []*lokiStream
+	for _, entry := range batch {
+		stream, found := bySeverity[entry.Severity]
+		if !found {
+			labels := make(map[string]string, len(s.labels)+1)
+			for k, v := range s.labels {
+				labels[k] = v
+			}
+			labels["severity"] = strings.ToLower(entry.Severity.String())
+			stream = &lokiStream{labels: labels}
+			bySeverity[entry.Severity] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, entry)
+	}
+	return streams
+}
+
+func lokiLine(entry logging.Entry) (string, error) {
+	if s, isString := entry.Payload.(string); isString {
+		return s, nil
+	}
+	b, err := json.Marshal(entry.Payload)
+	return string(b), err
+}
+
+func encodeLokiJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		js := jsonStream{Stream: stream.labels}
+		for _, entry := range stream.entries {
+			line, err := lokiLine(entry)
+			if err != nil {
+				return nil, err
+			}
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(entry.Timestamp.UnixNano(), 10), line})
+		}
+		req.Streams = append(req.Streams, js)
+	}
+	return json.Marshal(req)
+}
+
+// encodeLokiProtobuf encodes the streams as a logproto.PushRequest:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func encodeLokiProtobuf(streams []*lokiStream) ([]byte, error) {
+	var req []byte
+	for _, stream := range streams {
+		var sa []byte
+		sa = protowire.AppendTag(sa, 1, protowire.BytesType)
+		sa = protowire.AppendString(sa, lokiLabelString(stream.labels))
+		for _, entry := range stream.entries {
+			line, err := lokiLine(entry)
+			if err != nil {
+				return nil, err
+			}
+			var ts []byte
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(entry.Timestamp.Unix()))
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(entry.Timestamp.Nanosecond()))
+
+			var ea []byte
+			ea = protowire.AppendTag(ea, 1, protowire.BytesType)
+			ea = protowire.AppendBytes(ea, ts)
+			ea = protowire.AppendTag(ea, 2, protowire.BytesType)
+			ea = protowire.AppendString(ea, line)
+
+			sa = protowire.AppendTag(sa, 2, protowire.BytesType)
+			sa = protowire.AppendBytes(sa, ea)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, sa)
+	}
+	return req, nil
+}
+
+// lokiLabelString formats labels in the Prometheus format Loki expects, such as {host="a", severity="info"}
+func lokiLabelString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
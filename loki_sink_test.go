@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// lokiTestEntry is an entry of a Loki push request
+type lokiTestEntry struct {
+	timestamp time.Time
+	line      string
+}
+
+// decodeLokiProtobuf decodes the streams of a snappy compressed logproto.PushRequest, by their labels
+func decodeLokiProtobuf(t *testing.T, body []byte) map[string][]lokiTestEntry {
+	t.Helper()
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("error decompressing push request: %v", err)
+	}
+	fields := func(b []byte, fn func(num protowire.Number, v []byte, n uint64)) {
+		for len(b) > 0 {
+			num, typ, l := protowire.ConsumeTag(b)
+			if l < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(l))
+			}
+			b = b[l:]
+			switch typ {
+			case protowire.BytesType:
+				v, l := protowire.ConsumeBytes(b)
+				if l < 0 {
+					t.Fatalf("invalid field %d: %v", num, protowire.ParseError(l))
+				}
+				fn(num, v, 0)
+				b = b[l:]
+			case protowire.VarintType:
+				v, l := protowire.ConsumeVarint(b)
+				if l < 0 {
+					t.Fatalf("invalid field %d: %v", num, protowire.ParseError(l))
+				}
+				fn(num, nil, v)
+				b = b[l:]
+			default:
+				t.Fatalf("unexpected wire type %d of field %d", typ, num)
+			}
+		}
+	}
+
+	streams := make(map[string][]lokiTestEntry)
+	fields(b, func(_ protowire.Number, stream []byte, _ uint64) {
+		var labels string
+		var entries []lokiTestEntry
+		fields(stream, func(num protowire.Number, v []byte, _ uint64) {
+			if num == 1 {
+				labels = string(v)
+				return
+			}
+			var entry lokiTestEntry
+			fields(v, func(num protowire.Number, v []byte, _ uint64) {
+				if num == 2 {
+					entry.line = string(v)
+					return
+				}
+				var seconds, nanos uint64
+				fields(v, func(num protowire.Number, _ []byte, n uint64) {
+					if num == 1 {
+						seconds = n
+					} else {
+						nanos = n
+					}
+				})
+				entry.timestamp = time.Unix(int64(seconds), int64(nanos)).UTC()
+			})
+			entries = append(entries, entry)
+		})
+		streams[labels] = entries
+	})
+	return streams
+}
+
+// decodeLokiJSON decodes the streams of a JSON push request, by their labels formatted like in protobuf requests
+func decodeLokiJSON(t *testing.T, body []byte) map[string][]lokiTestEntry {
+	t.Helper()
+	var req struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatalf("error decoding push request: %v", err)
+	}
+	streams := make(map[string][]lokiTestEntry)
+	for _, s := range req.Streams {
+		var entries []lokiTestEntry
+		for _, v := range s.Values {
+			nanos, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil {
+				t.Fatalf("invalid timestamp %q: %v", v[0], err)
+			}
+			entries = append(entries, lokiTestEntry{timestamp: time.Unix(0, nanos).UTC(), line: v[1]})
+		}
+		streams[lokiLabelString(s.Stream)] = entries
+	}
+	return streams
+}
+
+func TestLokiSink(t *testing.T) {
+	for encoding, decode := range map[string]func(*testing.T, []byte) map[string][]lokiTestEntry{
+		lokiEncodingProtobuf: decodeLokiProtobuf,
+		lokiEncodingJSON:     decodeLokiJSON,
+	} {
+		t.Run(encoding, func(t *testing.T) {
+			h := newTestHarness(t)
+			loki := newCaptureServer(t, alwaysOK)
+
+			file := h.startContainer(t, logger.Info{
+				ContainerID:     "loki-container",
+				ContainerName:   "/api-1",
+				ContainerLabels: map[string]string{composeServiceLabel: "api"},
+				Config: map[string]string{
+					sinksKey:        lokiSinkKind,
+					lokiURLKey:      loki.URL,
+					lokiEncodingKey: encoding,
+					lokiLabelsKey:   "env=test",
+					lokiTenantIDKey: "tenant-1",
+				},
+			}, `{"level":"error","message":"boom"}`, "plain text line")
+			h.call(t, "StopLogging", StopLoggingRequest{File: file})
+			h.waitForStopped(t, 5*time.Second)
+
+			requests := loki.received()
+			if len(requests) != 1 {
+				t.Fatalf("expected 1 push request, got %d", len(requests))
+			}
+			req := requests[0]
+			if got := req.header.Get("X-Scope-OrgID"); got != "tenant-1" {
+				t.Errorf("tenant header = %q, want tenant-1", got)
+			}
+			streams := decode(t, req.body)
+
+			labels := map[string]string{
+				"env":             "test",
+				"container_name":  "api-1",
+				"compose_service": "api",
+				"host":            hostHostname(),
+			}
+			labels["severity"] = "error"
+			errorStream := lokiLabelString(labels)
+			labels["severity"] = "default"
+			defaultStream := lokiLabelString(labels)
+			if len(streams) != 2 || streams[errorStream] == nil || streams[defaultStream] == nil {
+				t.Fatalf("streams = %v, want %s and %s", streams, errorStream, defaultStream)
+			}
+
+			start := time.Date(2024, 3, 15, 11, 21, 40, 0, time.UTC)
+			for i, tc := range []struct {
+				stream string
+				line   string
+			}{
+				{errorStream, "boom"},
+				{defaultStream, "plain text line"},
+			} {
+				entries := streams[tc.stream]
+				if len(entries) != 1 {
+					t.Fatalf("expected 1 entry in %s, got %d", tc.stream, len(entries))
+				}
+				if want := start.Add(time.Duration(i) * time.Second); !entries[0].timestamp.Equal(want) {
+					t.Errorf("timestamp of %s = %v, want %v", tc.stream, entries[0].timestamp, want)
+				}
+				if !strings.Contains(entries[0].line, tc.line) {
+					t.Errorf("line of %s = %q, want it to contain %q", tc.stream, entries[0].line, tc.line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	lossReportIntervalKey = "loss-report-interval"
+
+	defaultLossReportInterval = time.Minute
+
+	// Reasons entries are lost for
+	lossOverflow       = "overflow"        // the buffer of a sink was full
+	lossRateLimited    = "rate-limited"    // the backend rejected the write for exceeding a quota
+	lossOversize       = "oversize"        // the entry was too large to be written
+	lossDeliveryFailed = "delivery-failed" // writing the entry failed for any other reason
+)
+
+// errRateLimited is wrapped by the errors of writes rejected for exceeding a quota
+var errRateLimited = errors.New("rate limited")
+
+// lossKey identifies the entries lost by a sink for a reason
+type lossKey struct {
+	sink   string
+	reason string
+}
+
+// lossCount is the number of entries lost by a sink for a reason, as reported in the health endpoint and the loss
+// reports
+type lossCount struct {
+	Sink   string `json:"sink"`
+	Reason string `json:"reason"`
+	Count  uint64 `json:"count"`
+}
+
+// lossReport is the number of entries of a container lost between two times
+type lossReport struct {
+	From   time.Time
+	To     time.Time
+	Losses []lossCount
+}
+
+func (r lossReport) total() uint64 {
+	var total uint64
+	for _, l := range r.Losses {
+		total += l.Count
+	}
+	return total
+}
+
+// lossTracker counts the entries of a container lost by its sinks. The losses since the last report are written to
+// the container's own log stream by nGCPLogger, so gaps are visible next to the entries around them
+type lossTracker struct {
+	containerID string
+	metrics     *containerMetrics
+
+	mu     sync.Mutex
+	period map[lossKey]uint64
+	from   time.Time
+	to     time.Time
+	totals map[lossKey]uint64
+}
+
+func newLossTracker(containerID string, metrics *containerMetrics) *lossTracker {
+	return &lossTracker{
+		containerID: containerID,
+		metrics:     metrics,
+		period:      make(map[lossKey]uint64),
+		totals:      make(map[lossKey]uint64),
+	}
+}
+
+func parseLossReportInterval(cfg map[string]string) (time.Duration, error) {
+	v, found := cfg[lossReportIntervalKey]
+	if !found {
+		return defaultLossReportInterval, nil
+	}
+	interval, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || interval < 0 {
+		return 0, fmt.Errorf("%s must be a non negative number of milliseconds, got %q", lossReportIntervalKey, v)
+	}
+	return time.Duration(interval) * time.Millisecond, nil
+}
+
+// add records n entries lost by the sink, logging the first loss for each reason and every 1000th after
+func (t *lossTracker) add(sink, reason string, n int) {
+	if n <= 0 {
+		return
+	}
+	key := lossKey{sink: sink, reason: reason}
+	now := time.Now()
+
+	t.mu.Lock()
+	if len(t.period) == 0 {
+		t.from = now
+	}
+	t.to = now
+	t.period[key] += uint64(n)
+	before := t.totals[key]
+	t.totals[key] += uint64(n)
+	total := t.totals[key]
+	t.mu.Unlock()
+	t.metrics.lost(sink, reason, n)
+
+	if before == 0 || before/1000 != total/1000 {
+		slog.Warn("entries lost", "id", t.containerID, "sink", sink, "reason", reason, "count", total)
+	}
+}
+
+// addError records an entry lost by the sink because of err
+func (t *lossTracker) addError(sink string, err error) {
+	t.add(sink, lossReasonOf(err), 1)
+}
+
+// onError handles the errors reported by the Cloud Logging client of a destination. Failed writes are recorded by
+// recordWrites with the number of entries they held, so only the entries rejected before being sent are counted here
+func (t *lossTracker) onError(sink string) func(error) {
+	return func(err error) {
+		switch {
+		case errors.Is(err, logging.ErrOverflow), errors.Is(err, logging.ErrOversizedEntry):
+			// The entry was counted as queued by gcpDestination.Log, but never made it into the queue
+			t.metrics.enqueued(sink, -1)
+			t.addError(sink, err)
+		case isStatusError(err):
+			slog.Error("error writing to Cloud Logging", "id", t.containerID, "sink", sink, "error", err)
+		default:
+			slog.Error("error converting entry for Cloud Logging", "id", t.containerID, "sink", sink, "error", err)
+			t.metrics.enqueued(sink, -1)
+			t.add(sink, lossDeliveryFailed, 1)
+		}
+	}
+}
+
+// take returns the losses since the last call, and starts a new period
+func (t *lossTracker) take() lossReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := lossReport{From: t.from, To: t.to, Losses: sortedLosses(t.period)}
+	clear(t.period)
+	return r
+}
+
+// snapshot returns the losses since the container started
+func (t *lossTracker) snapshot() []lossCount {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return sortedLosses(t.totals)
+}
+
+func sortedLosses(counts map[lossKey]uint64) []lossCount {
+	losses := make([]lossCount, 0, len(counts))
+	for k, n := range counts {
+		losses = append(losses, lossCount{Sink: k.sink, Reason: k.reason, Count: n})
+	}
+	slices.SortFunc(losses, func(a, b lossCount) int {
+		return strings.Compare(a.Sink+"\x00"+a.Reason, b.Sink+"\x00"+b.Reason)
+	})
+	return losses
+}
+
+// lossReasonOf classifies the error an entry was lost with
+func lossReasonOf(err error) string {
+	switch {
+	case errors.Is(err, errSinkOverflow), errors.Is(err, errStartupBufferFull), errors.Is(err, logging.ErrOverflow):
+		return lossOverflow
+	case errors.Is(err, logging.ErrOversizedEntry):
+		return lossOversize
+	case errors.Is(err, errRateLimited), status.Code(err) == codes.ResourceExhausted:
+		return lossRateLimited
+	}
+	return lossDeliveryFailed
+}
+
+func isStatusError(err error) bool {
+	var s interface{ GRPCStatus() *status.Status }
+	return errors.As(err, &s)
+}
+
+// lossReportEntry is the WARNING entry written to the container's log stream for the losses of a report
+func lossReportEntry(r lossReport, instance *instanceInfo, container *containerInfo) logging.Entry {
+	reasons := make(map[string]uint64)
+	var order []string
+	losses := make([]any, len(r.Losses))
+	for i, l := range r.Losses {
+		if _, found := reasons[l.Reason]; !found {
+			order = append(order, l.Reason)
+		}
+		reasons[l.Reason] += l.Count
+		losses[i] = map[string]any{"sink": l.Sink, "reason": l.Reason, "count": l.Count}
+	}
+	slices.Sort(order)
+	var byReason []string
+	for _, reason := range order {
+		byReason = append(byReason, fmt.Sprintf("%d %s", reasons[reason], reason))
+	}
+
+	payload := map[string]any{
+		"message": fmt.Sprintf("ngcplogs lost %d entries of this container between %s and %s (%s)",
+			r.total(), r.From.UTC().Format(time.RFC3339), r.To.UTC().Format(time.RFC3339), strings.Join(byReason, ", ")),
+		name: map[string]any{
+			"lost":   r.total(),
+			"from":   r.From.UTC().Format(time.RFC3339Nano),
+			"to":     r.To.UTC().Format(time.RFC3339Nano),
+			"losses": losses,
+		},
+		"container": container,
+	}
+	if instance != nil {
+		payload["instance"] = instance
+	}
+	return logging.Entry{
+		Timestamp: time.Now(),
+		Severity:  logging.Warning,
+		Payload:   payload,
+	}
+}
+
+// writeResult holds the outcome of a call writing entries to Cloud Logging, filled by recordWriteResult
+type writeResult struct {
+	entries int
+	bytes   int
+	err     error
+}
+
+type writeResultKey struct{}
+
+// recordWriteResult is the interceptor of the Cloud Logging connections, storing the outcome of the last attempt of
+// a write in the writeResult of its context
+func recordWriteResult(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if result, found := ctx.Value(writeResultKey{}).(*writeResult); found {
+		if r, isWrite := req.(*loggingpb.WriteLogEntriesRequest); isWrite {
+			// The client adds an instrumentation entry to its first write, with its own log name, which was never
+			// counted as queued
+			result.entries = 0
+			for _, e := range r.GetEntries() {
+				if e.GetLogName() == "" {
+					result.entries++
+				}
+			}
+			result.bytes = proto.Size(r)
+			result.err = err
+		}
+	}
+	return err
+}
+
+// recordWrites returns the logging.ContextFunc of a destination's logger, recording the metrics of every write and
+// counting the entries of the writes that still failed once retries were exhausted or ctx was canceled
+func (t *lossTracker) recordWrites(ctx context.Context, sink string) logging.LoggerOption {
+	return logging.ContextFunc(func() (context.Context, func()) {
+		result := &writeResult{}
+		start := time.Now()
+		return context.WithValue(ctx, writeResultKey{}, result), func() {
+			t.metrics.written(sink, result.entries, result.bytes, time.Since(start), result.err)
+			if result.err != nil {
+				t.add(sink, lossReasonOf(result.err), result.entries)
+			}
+		}
+	})
+}
+
+// lossRecorder is implemented by the sinks that lose entries after Log returned, such as when a batch fails
+type lossRecorder interface {
+	setLossTracker(t *lossTracker)
+}
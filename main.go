@@ -7,11 +7,29 @@ package main
 import (
 	"github.com/docker/go-plugins-helpers/sdk"
 	"log"
-	_ "net/http/pprof"
 )
 
 func main() {
+	// The configuration file is loaded first, since the plugin logs can use its credentials profiles
+	if err := loadHostConfig(); err != nil {
+		log.Fatalf("Error loading the configuration file: %s", err)
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatalf("Error setting up the plugin logs: %s", err)
+	}
+	if err := serveMetrics(); err != nil {
+		log.Fatalf("Error serving metrics: %s", err)
+	}
 	nGCPDriver := createDriver()
+	if err := watchHostConfig(nGCPDriver); err != nil {
+		log.Fatalf("Error watching the configuration file: %s", err)
+	}
+	if err := serveDiagnostics(nGCPDriver); err != nil {
+		log.Fatalf("Error serving diagnostics: %s", err)
+	}
+	if err := handleShutdown(nGCPDriver); err != nil {
+		log.Fatalf("Error handling the shutdown of the plugin: %s", err)
+	}
 
 	sdkHandler := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
 	registerHandlers(&sdkHandler, nGCPDriver)
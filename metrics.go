@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsAddressEnv is the plugin setting with the address the metrics are served on, either host:port or
+// unix:///path for a socket inside the plugin's rootfs. Metrics are not served if empty
+const metricsAddressEnv = "metrics-address"
+
+var (
+	containerLabels   = []string{"container_name", "image"}
+	destinationLabels = append(containerLabels[:len(containerLabels):len(containerLabels)], "destination")
+
+	metricsRegistry = prometheus.NewRegistry()
+
+	linesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "lines_read_total",
+		Help:      "Lines read from the FIFO of the container.",
+	}, containerLabels)
+	parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "parse_errors_total",
+		Help:      "Lines that looked like JSON but failed to parse.",
+	}, containerLabels)
+	entriesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "entries_sent_total",
+		Help:      "Entries successfully written to the destination.",
+	}, destinationLabels)
+	bytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "bytes_sent_total",
+		Help:      "Size of the requests successfully written to the destination. Only reported for Cloud Logging.",
+	}, destinationLabels)
+	entriesLost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: name,
+		Name:      "entries_lost_total",
+		Help:      "Entries that could not be written to the destination, by reason.",
+	}, append(destinationLabels[:len(destinationLabels):len(destinationLabels)], "reason"))
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: name,
+		Name:      "queue_depth",
+		Help:      "Entries logged to the destination that are waiting to be written.",
+	}, destinationLabels)
+	writeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: name,
+		Name:      "write_duration_seconds",
+		Help:      "Duration of the writes to the destination, including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, destinationLabels)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		linesRead, parseErrors, entriesSent, bytesSent, entriesLost, queueDepth, writeDuration,
+	)
+}
+
+// serveMetrics serves the metrics on the address of the metrics-address setting, if set
+func serveMetrics() error {
+	address := os.Getenv(metricsAddressEnv)
+	if address == "" {
+		return nil
+	}
+	l, err := listen(address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s %q: %w", metricsAddressEnv, address, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("error serving metrics", "error", err)
+		}
+	}()
+	slog.Info("serving metrics", "address", address)
+	return nil
+}
+
+// listen listens on a host:port address, or a unix socket for unix:///path addresses
+func listen(address string) (net.Listener, error) {
+	if path, isUnix := strings.CutPrefix(address, "unix://"); isUnix {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+}
+
+// containerMetrics records the metrics of a container, remembering the destinations and reasons it used so its
+// series can be deleted once it stops
+type containerMetrics struct {
+	labels []string
+	// queued is the number of entries of the container waiting to be written, to all its destinations
+	queued atomic.Int64
+
+	shared *containerSeries
+}
+
+// containerSeries are the series of the loggers with the same container name and image. A restarted container gets
+// a new logger while the previous one may still be flushing, and a reloaded one replaces its logger, so the series are
+// only deleted once the last of them is closed
+type containerSeries struct {
+	refs int // guarded by seriesMu
+
+	mu     sync.Mutex
+	series map[lossKey]bool
+}
+
+var (
+	seriesMu          sync.Mutex
+	seriesByContainer = make(map[string]*containerSeries)
+)
+
+func newContainerMetrics(container *containerInfo) *containerMetrics {
+	m := &containerMetrics{labels: []string{strings.TrimPrefix(container.Name, "/"), container.ImageName}}
+	key := strings.Join(m.labels, "\x00")
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+	m.shared = seriesByContainer[key]
+	if m.shared == nil {
+		m.shared = &containerSeries{series: make(map[lossKey]bool)}
+		seriesByContainer[key] = m.shared
+	}
+	m.shared.refs++
+	return m
+}
+
+func (m *containerMetrics) destinationLabels(dst, reason string) []string {
+	m.shared.mu.Lock()
+	m.shared.series[lossKey{sink: dst, reason: reason}] = true
+	m.shared.mu.Unlock()
+	labels := append(m.labels[:len(m.labels):len(m.labels)], dst)
+	if reason != "" {
+		labels = append(labels, reason)
+	}
+	return labels
+}
+
+func (m *containerMetrics) lineRead() {
+	linesRead.WithLabelValues(m.labels...).Inc()
+}
+
+func (m *containerMetrics) parseError() {
+	parseErrors.WithLabelValues(m.labels...).Inc()
+}
+
+// enqueued records entries waiting to be written to the destination
+func (m *containerMetrics) enqueued(dst string, entries int) {
+	m.queued.Add(int64(entries))
+	queueDepth.WithLabelValues(m.destinationLabels(dst, "")...).Add(float64(entries))
+}
+
+// written records a write of entries to the destination that took d, which removes them from its queue. bytes is
+// the size of the request, or 0 if unknown
+func (m *containerMetrics) written(dst string, entries, bytes int, d time.Duration, err error) {
+	m.queued.Add(-int64(entries))
+	labels := m.destinationLabels(dst, "")
+	queueDepth.WithLabelValues(labels...).Sub(float64(entries))
+	writeDuration.WithLabelValues(labels...).Observe(d.Seconds())
+	if err == nil {
+		entriesSent.WithLabelValues(labels...).Add(float64(entries))
+		if bytes > 0 {
+			bytesSent.WithLabelValues(labels...).Add(float64(bytes))
+		}
+	}
+}
+
+func (m *containerMetrics) lost(dst, reason string, entries int) {
+	entriesLost.WithLabelValues(m.destinationLabels(dst, reason)...).Add(float64(entries))
+}
+
+// delete releases the series of the container, removing them unless another logger of the container still uses
+// them
+func (m *containerMetrics) delete() {
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+	if m.shared.refs--; m.shared.refs > 0 {
+		return
+	}
+	delete(seriesByContainer, strings.Join(m.labels, "\x00"))
+
+	linesRead.DeleteLabelValues(m.labels...)
+	parseErrors.DeleteLabelValues(m.labels...)
+	m.shared.mu.Lock()
+	defer m.shared.mu.Unlock()
+	for k := range m.shared.series {
+		labels := append(m.labels[:len(m.labels):len(m.labels)], k.sink)
+		if k.reason != "" {
+			entriesLost.DeleteLabelValues(append(labels, k.reason)...)
+			continue
+		}
+		entriesSent.DeleteLabelValues(labels...)
+		bytesSent.DeleteLabelValues(labels...)
+		queueDepth.DeleteLabelValues(labels...)
+		writeDuration.DeleteLabelValues(labels...)
+	}
+}
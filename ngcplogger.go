@@ -10,19 +10,15 @@ import (
 	"net/url"
 	"reflect"
 	"runtime"
+	"slices"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	"google.golang.org/api/option"
-
 	"github.com/docker/docker/daemon/logger"
 
 	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/logging"
 	"cloud.google.com/go/logging/apiv2/loggingpb"
-	"github.com/containerd/log"
-	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
 )
 
 const (
@@ -42,9 +38,6 @@ const (
 )
 
 var (
-	// The number of logs the gcplogs driver has dropped.
-	droppedLogs uint64
-
 	onGCE bool
 
 	// instance metadata populated from the metadata server if available
@@ -76,12 +69,19 @@ func init() {
 }
 
 type nGCPLogger struct {
-	client    *logging.Client
-	logger    *logging.Logger
+	sinks     []Sink
+	oversize  *oversizeGuard // nil when not writing to Cloud Logging
+	losses    *lossTracker
+	metrics   *containerMetrics
 	instance  *instanceInfo
 	container *containerInfo
 	projectID string
 
+	stopReports chan struct{}
+	reportsDone chan struct{}
+	// abortWrites cancels the connection attempts and writes in progress, to Cloud Logging and the batch sinks
+	abortWrites context.CancelFunc
+
 	extractJsonMessage bool
 	extractSeverity    bool
 	excludeTimestamp   bool
@@ -130,35 +130,13 @@ func initGCP() {
 	})
 }
 
-// New creates a new logger that logs to Google Cloud Logging using the application
-// default credentials.
+// New creates a new logger that processes the container logs and writes them to the
+// configured sinks, by default Google Cloud Logging using the application default credentials.
 //
 // See https://developers.google.com/identity/protocols/application-default-credentials
 func New(info logger.Info) (logger.Logger, error) {
 	initGCP()
 
-	var project string
-	if projectID != "" {
-		project = projectID
-	}
-	if projectID, found := info.Config[projectOptKey]; found {
-		project = projectID
-	}
-	if project == "" {
-		return nil, fmt.Errorf("no project was specified and couldn't read project from the metadata server. Please specify a project")
-	}
-
-	var opts []option.ClientOption
-	if credentialsFile, found := info.Config[clientCredentialsFile]; found {
-		opts = append(opts, option.WithCredentialsFile(fmt.Sprintf("/host/%s", credentialsFile)))
-	} else if credentialsJSON, found := info.Config[clientCredentialsJSON]; found {
-		opts = append(opts, option.WithCredentialsJSON([]byte(credentialsJSON)))
-	}
-
-	c, err := logging.NewClient(context.Background(), project, opts...)
-	if err != nil {
-		return nil, err
-	}
 	var instanceResource *instanceInfo
 	if onGCE {
 		instanceResource = &instanceInfo{
@@ -174,41 +152,80 @@ func New(info logger.Info) (logger.Logger, error) {
 		}
 	}
 
-	var options []logging.LoggerOption
-	if instanceResource != nil {
-		vmMrpb := logging.CommonResource(
-			&mrpb.MonitoredResource{
-				Type: "gce_instance",
-				Labels: map[string]string{
-					"instance_id": instanceResource.ID,
-					"zone":        instanceResource.Zone,
-				},
-			},
-		)
-		options = []logging.LoggerOption{vmMrpb}
+	extraAttributes, err := info.ExtraAttributes(nil)
+	if err != nil {
+		return nil, err
 	}
-	lg := c.Logger("ngcplogs-docker-driver", options...)
 
-	if err := c.Ping(context.Background()); err != nil {
-		return nil, fmt.Errorf("unable to connect or authenticate with Google Cloud Logging: %v", err)
+	container := &containerInfo{
+		Name:      info.ContainerName,
+		ID:        info.ContainerID,
+		ImageName: info.ContainerImageName,
+		ImageID:   info.ContainerImageID,
+		Created:   info.ContainerCreated,
+		Metadata:  extraAttributes,
+	}
+	if info.Config[logCmdKey] == "true" {
+		container.Command = info.Command()
 	}
 
-	extraAttributes, err := info.ExtraAttributes(nil)
+	resource, err := newMonitoredResource(info, instanceResource, container)
+	if err != nil {
+		return nil, err
+	}
+
+	sinkKinds, err := parseSinkKinds(info.Config[sinksKey])
 	if err != nil {
 		return nil, err
 	}
 
+	reportInterval, err := parseLossReportInterval(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	metrics := newContainerMetrics(container)
+	losses := newLossTracker(info.ContainerID, metrics)
+
+	writeCtx, abortWrites := context.WithCancel(context.Background())
+	var sinks []Sink
+	var project string
+	var oversize *oversizeGuard
+	if slices.Contains(sinkKinds, gcpSinkKind) {
+		sinks, project, err = newGcpSinks(writeCtx, info, resource, losses)
+		if err != nil {
+			abortWrites()
+			metrics.delete()
+			return nil, err
+		}
+		oversize, err = newOversizeGuard(info.Config, project, sinks, resource, instanceResource, container)
+		if err != nil {
+			closeSinks(sinks)
+			abortWrites()
+			metrics.delete()
+			return nil, err
+		}
+	}
+	otherSinks, err := newSinks(writeCtx, info, sinkKinds, templateData{Container: container, Instance: instanceResource, Hostname: hostHostname()})
+	if err != nil {
+		closeSinks(sinks)
+		abortWrites()
+		metrics.delete()
+		return nil, err
+	}
+	for _, s := range otherSinks {
+		if r, isRecorder := s.(lossRecorder); isRecorder {
+			r.setLossTracker(losses)
+		}
+	}
+	sinks = append(sinks, otherSinks...)
+
 	l := &nGCPLogger{
-		client: c,
-		logger: lg,
-		container: &containerInfo{
-			Name:      info.ContainerName,
-			ID:        info.ContainerID,
-			ImageName: info.ContainerImageName,
-			ImageID:   info.ContainerImageID,
-			Created:   info.ContainerCreated,
-			Metadata:  extraAttributes,
-		},
+		sinks:              sinks,
+		oversize:           oversize,
+		losses:             losses,
+		metrics:            metrics,
+		abortWrites:        abortWrites,
+		container:          container,
 		projectID:          project,
 		extractJsonMessage: true,
 		extractSeverity:    true,
@@ -218,10 +235,6 @@ func New(info logger.Info) (logger.Logger, error) {
 		extractCaddy:       false,
 	}
 
-	if info.Config[logCmdKey] == "true" {
-		l.container.Command = info.Command()
-	}
-
 	if info.Config["extract-json-message"] == "false" {
 		l.extractJsonMessage = false
 	}
@@ -245,42 +258,22 @@ func New(info logger.Info) (logger.Logger, error) {
 		l.instance = instanceResource
 	}
 
-	// The logger "overflows" at a rate of 10,000 logs per second and this
-	// overflow func is called. We want to surface the error to the user
-	// without overly spamming /var/log/docker.log so we log the first time
-	// we overflow and every 1000th time after.
-	c.OnError = func(err error) {
-		if errors.Is(err, logging.ErrOverflow) {
-			if i := atomic.AddUint64(&droppedLogs, 1); i%1000 == 1 {
-				log.G(context.TODO()).Errorf("ngcplogs driver has dropped %v logs", i)
-			}
-		} else {
-			log.G(context.TODO()).Error(err)
-		}
+	if reportInterval > 0 {
+		l.stopReports = make(chan struct{})
+		l.reportsDone = make(chan struct{})
+		go l.reportLosses(reportInterval)
 	}
 
 	return l, nil
 }
 
-// ValidateLogOpts validates the opts passed to the ngcplogs driver. Currently, the ngcplogs
-// driver doesn't take any arguments.
-func ValidateLogOpts(cfg map[string]string) error {
-	for k := range cfg {
-		switch k {
-		case projectOptKey, logLabelsKey, logLabelsRegexKey, logEnvKey, logEnvRegexKey, logCmdKey, logZoneKey, logNameKey, logIDKey:
-		default:
-			return fmt.Errorf("%q is not a valid option for the ngcplogs driver", k)
-		}
-	}
-	return nil
-}
-
 func (l *nGCPLogger) Log(lMsg *logger.Message) error {
 	logLine := lMsg.Line
 	ts := lMsg.Timestamp
 	logger.PutMessage(lMsg)
 
 	if len(logLine) > 0 {
+		l.metrics.lineRead()
 		var payload any
 		entry := logging.Entry{
 			Labels:    map[string]string{},
@@ -292,6 +285,7 @@ func (l *nGCPLogger) Log(lMsg *logger.Message) error {
 			var m map[string]any
 			err := json.Unmarshal(logLine, &m)
 			if err != nil {
+				l.metrics.parseError()
 				payload = fmt.Sprintf("Error parsing JSON: %s", string(logLine))
 				entry.Severity = logging.Critical
 			} else {
@@ -313,11 +307,61 @@ func (l *nGCPLogger) Log(lMsg *logger.Message) error {
 		}
 
 		entry.Payload = payload
-		l.logger.Log(entry)
+		var gcpEntries []logging.Entry
+		if l.oversize != nil {
+			gcpEntries = l.oversize.apply(entry, len(logLine))
+		}
+		for _, s := range l.sinks {
+			if !isGcpSink(s) {
+				l.logToSink(s, entry)
+				continue
+			}
+			if len(gcpEntries) == 0 {
+				l.losses.add(s.String(), lossOversize, 1)
+			}
+			for _, e := range gcpEntries {
+				l.logToSink(s, e)
+			}
+		}
 	}
 	return nil
 }
 
+func (l *nGCPLogger) logToSink(s Sink, entry logging.Entry) {
+	if err := s.Log(entry); err != nil {
+		slog.Error("error writing entry to sink", "sink", s, "id", l.container.ID, "error", err)
+		l.losses.addError(s.String(), err)
+	}
+}
+
+// reportLosses writes the entries lost since the last report to the container's log stream every interval, until
+// Close writes the last report
+func (l *nGCPLogger) reportLosses(interval time.Duration) {
+	defer close(l.reportsDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.writeLossReport()
+		case <-l.stopReports:
+			return
+		}
+	}
+}
+
+// writeLossReport writes a WARNING entry with the entries lost since the last report to every sink, if any were
+func (l *nGCPLogger) writeLossReport() {
+	r := l.losses.take()
+	if len(r.Losses) == 0 {
+		return
+	}
+	entry := lossReportEntry(r, l.instance, l.container)
+	for _, s := range l.sinks {
+		l.logToSink(s, entry)
+	}
+}
+
 func (l *nGCPLogger) extractSeverityFromPayload(m map[string]any) logging.Severity {
 	severity := logging.Default
 
@@ -494,12 +538,42 @@ func (l *nGCPLogger) extractCaddyFromPayload(m map[string]any, entry *logging.En
 	}
 }
 
-func (l *nGCPLogger) Close() error {
-	err := l.logger.Flush()
-	if err != nil {
-		return err
+// Flush sends all buffered entries of every sink, returning the first error encountered
+func (l *nGCPLogger) Flush() error {
+	var firstErr error
+	for _, s := range l.sinks {
+		if err := s.Flush(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error flushing entries to %s: %w", s, err)
+		}
 	}
-	return l.client.Close()
+	return firstErr
+}
+
+func (l *nGCPLogger) health() []sinkHealth {
+	var sinks []sinkHealth
+	for _, s := range l.sinks {
+		sinks = append(sinks, healthOf(s))
+	}
+	return sinks
+}
+
+// Close writes the last report of the lost entries, then flushes and closes the sinks. The series of the container
+// are deleted unless another logger of the container still uses them
+func (l *nGCPLogger) Close() error {
+	if l.stopReports != nil {
+		close(l.stopReports)
+		<-l.reportsDone
+	}
+	l.writeLossReport()
+	defer l.metrics.delete()
+	defer l.abortWrites()
+	return errors.Join(l.Flush(), closeSinks(l.sinks))
+}
+
+// abort cancels the connection attempts and writes in progress, along with the retries of the batch sinks, so a Close
+// waiting for them returns. The entries of the canceled writes are counted as lost
+func (l *nGCPLogger) abort() {
+	l.abortWrites()
 }
 
 func (l *nGCPLogger) Name() string {
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type optionKind int
+
+const (
+	optString optionKind = iota
+	optBool
+	optInt
+	optEnum
+	// optEnumList is a comma separated list of values of an enum
+	optEnumList
+)
+
+// optionSpec describes the values an option accepts
+type optionSpec struct {
+	kind optionKind
+	// min is the minimum value of optInt options
+	min int
+	// unit is the unit of optInt options, if any
+	unit string
+	// values are the allowed values of optEnum and optEnumList options
+	values []string
+}
+
+var (
+	stringOpt       = optionSpec{kind: optString}
+	boolOpt         = optionSpec{kind: optBool}
+	positiveOpt     = optionSpec{kind: optInt, min: 1}
+	nonNegativeOpt  = optionSpec{kind: optInt, min: 0}
+	millisecondsOpt = optionSpec{kind: optInt, min: 1, unit: "milliseconds"}
+	bytesOpt        = optionSpec{kind: optInt, min: 1, unit: "bytes"}
+)
+
+func enumOpt(values ...string) optionSpec {
+	return optionSpec{kind: optEnum, values: values}
+}
+
+// optionSchema holds every option of the ngcplogs driver, as log-opts or in the profiles of the configuration file.
+// The values are checked further when the option is parsed, such as for the limits between options
+var optionSchema = map[string]optionSpec{
+	"extract-json-message": boolOpt,
+	"extract-severity":     boolOpt,
+	"exclude-timestamp":    boolOpt,
+	"extract-msg":          boolOpt,
+	"extract-gcp":          boolOpt,
+	"extract-caddy":        boolOpt,
+	localLoggingConfig:     boolOpt,
+	sleepIntervalConfig:    millisecondsOpt,
+	flushTimeoutConfig:     millisecondsOpt,
+	clientCredentialsFile:  stringOpt,
+	clientCredentialsJSON:  stringOpt,
+	impersonateKey:         stringOpt,
+	delegatesKey:           stringOpt,
+	credentialsProfileKey:  stringOpt,
+	profileKey:             stringOpt,
+
+	projectOptKey:     stringOpt,
+	logLabelsKey:      stringOpt,
+	logLabelsRegexKey: stringOpt,
+	logEnvKey:         stringOpt,
+	logEnvRegexKey:    stringOpt,
+	logCmdKey:         boolOpt,
+	logZoneKey:        stringOpt,
+	logNameKey:        stringOpt,
+	logIDKey:          stringOpt,
+
+	routesKey:             stringOpt,
+	mirrorDestinationsKey: stringOpt,
+	endpointKey:           stringOpt,
+	insecureKey:           boolOpt,
+	caFileKey:             stringOpt,
+	startupModeKey:        enumOpt(startupModeStrict, startupModeLazy),
+	startupBufferKey:      enumOpt(startupBufferMemory, startupBufferDisk),
+	startupBufferSizeKey:  positiveOpt,
+	maxEntrySizeKey:       bytesOpt,
+	oversizePolicyKey:     enumOpt(oversizeTruncate, oversizeSplit, oversizeDropFields, oversizeDrop),
+	lossReportIntervalKey: optionSpec{kind: optInt, min: 0, unit: "milliseconds"},
+
+	bundlerPresetKey:        enumOpt(bundlerPresetLowLatency, bundlerPresetHighThroughput),
+	delayThresholdKey:       millisecondsOpt,
+	entryCountThresholdKey:  positiveOpt,
+	entryByteThresholdKey:   bytesOpt,
+	bufferedByteLimitKey:    bytesOpt,
+	concurrentWriteLimitKey: positiveOpt,
+
+	resourceTypeKey:      enumOpt(resourceTypeGCEInstance, resourceTypeGenericNode, resourceTypeGenericTask, resourceTypeGlobal),
+	resourceLocationKey:  stringOpt,
+	resourceNamespaceKey: stringOpt,
+	resourceNodeIDKey:    stringOpt,
+	resourceJobKey:       stringOpt,
+	resourceTaskIDKey:    stringOpt,
+
+	sinksKey:    {kind: optEnumList, values: sinkKinds},
+	filePathKey: stringOpt,
+
+	webhookURLKey:           stringOpt,
+	webhookBatchSizeKey:     positiveOpt,
+	webhookFlushIntervalKey: millisecondsOpt,
+	webhookMaxRetriesKey:    nonNegativeOpt,
+
+	otlpEndpointKey:      stringOpt,
+	otlpProtocolKey:      enumOpt(otlpProtocolHTTP, otlpProtocolGRPC),
+	otlpInsecureKey:      boolOpt,
+	otlpHeadersKey:       stringOpt,
+	otlpBatchSizeKey:     positiveOpt,
+	otlpFlushIntervalKey: millisecondsOpt,
+	otlpMaxRetriesKey:    nonNegativeOpt,
+
+	lokiURLKey:           stringOpt,
+	lokiEncodingKey:      enumOpt(lokiEncodingProtobuf, lokiEncodingJSON),
+	lokiLabelsKey:        stringOpt,
+	lokiTenantIDKey:      stringOpt,
+	lokiBatchSizeKey:     positiveOpt,
+	lokiFlushIntervalKey: millisecondsOpt,
+	lokiMaxRetriesKey:    nonNegativeOpt,
+
+	syslogAddressKey:       stringOpt,
+	syslogFacilityKey:      {kind: optEnum, values: slices.DeleteFunc(slices.Clone(syslogFacilities), func(f string) bool { return f == "" })},
+	syslogTagKey:           stringOpt,
+	syslogFramingKey:       enumOpt(syslogFramingOctetCounted, syslogFramingNonTransparent),
+	syslogPayloadKey:       enumOpt(syslogPayloadJSON, syslogPayloadStructuredData),
+	syslogTLSCACertKey:     stringOpt,
+	syslogTLSCertKey:       stringOpt,
+	syslogTLSKeyKey:        stringOpt,
+	syslogTLSSkipVerifyKey: boolOpt,
+	syslogBatchSizeKey:     positiveOpt,
+	syslogFlushIntervalKey: millisecondsOpt,
+	syslogMaxRetriesKey:    nonNegativeOpt,
+}
+
+// daemonLogOpts are the log-opts handled by the docker daemon itself, for the delivery mode and dual logging, which
+// it passes on to the logging plugins along with theirs
+var daemonLogOpts = []string{
+	"mode",
+	"max-buffer-size",
+	"max-size",
+	"max-file",
+	"compress",
+	"cache-disabled",
+	"cache-max-size",
+	"cache-max-file",
+	"cache-compress",
+}
+
+// ValidateLogOpts validates the options of a container against the schema of the ngcplogs driver, returning an
+// error listing every unknown option and invalid value, with suggestions for the misspelled ones
+func ValidateLogOpts(cfg map[string]string) error {
+	keys := make([]string, 0, len(cfg))
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var errs []error
+	for _, k := range keys {
+		if slices.Contains(daemonLogOpts, k) {
+			continue
+		}
+		spec, found := optionSchema[k]
+		if !found {
+			errs = append(errs, fmt.Errorf("unknown log-opt %q%s", k, didYouMean(k, optionNames())))
+			continue
+		}
+		if err := spec.validate(cfg[k]); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for log-opt %s: %w", cfg[k], k, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the value of an option. Empty values of booleans and enums select their default
+func (s optionSpec) validate(v string) error {
+	if v == "" && s.kind != optString && s.kind != optInt {
+		return nil
+	}
+	switch s.kind {
+	case optBool:
+		if v != "true" && v != "false" {
+			return fmt.Errorf("must be true or false%s", didYouMean(strings.ToLower(v), []string{"true", "false"}))
+		}
+	case optInt:
+		n, err := strconv.Atoi(v)
+		if err != nil || n < s.min {
+			msg := fmt.Sprintf("must be an integer of at least %d", s.min)
+			if s.unit != "" {
+				msg += " " + s.unit
+			}
+			return errors.New(msg)
+		}
+	case optEnum:
+		if !slices.Contains(s.values, v) {
+			return fmt.Errorf("must be one of %s%s", strings.Join(s.values, ", "), didYouMean(v, s.values))
+		}
+	case optEnumList:
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if !slices.Contains(s.values, item) {
+				return fmt.Errorf("%q must be one of %s%s", item, strings.Join(s.values, ", "), didYouMean(item, s.values))
+			}
+		}
+	}
+	return nil
+}
+
+func optionNames() []string {
+	names := make([]string, 0, len(optionSchema))
+	for k := range optionSchema {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// didYouMean returns a suggestion of the candidate closest to s, if it is close enough to be a typo of it
+func didYouMean(s string, candidates []string) string {
+	best, bestDistance := "", max(2, len(s)/3)+1
+	for _, c := range candidates {
+		if d := levenshtein(s, c); d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+	if best == "" || best == s {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// levenshtein returns the number of single character insertions, deletions and substitutions to turn a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
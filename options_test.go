@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLogOpts(t *testing.T) {
+	err := ValidateLogOpts(map[string]string{
+		"extract-severty":   "false",
+		startupModeKey:      "lasy",
+		sleepIntervalConfig: "0",
+		projectOptKey:       testProject,
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		`unknown log-opt "extract-severty", did you mean "extract-severity"?`,
+		`invalid value "lasy" for log-opt startup-mode: must be one of strict, lazy, did you mean "lazy"?`,
+		`invalid value "0" for log-opt sleep-interval: must be an integer of at least 1 milliseconds`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+
+	if err := ValidateLogOpts(map[string]string{sinksKey: "gcp, stdout", insecureKey: "true"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/docker/docker/daemon/logger"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpEndpointKey      = "otlp-endpoint"
+	otlpProtocolKey      = "otlp-protocol"
+	otlpInsecureKey      = "otlp-insecure"
+	otlpHeadersKey       = "otlp-headers"
+	otlpBatchSizeKey     = "otlp-batch-size"
+	otlpFlushIntervalKey = "otlp-flush-interval"
+	otlpMaxRetriesKey    = "otlp-max-retries"
+
+	otlpProtocolHTTP = "http/protobuf"
+	otlpProtocolGRPC = "grpc"
+
+	otlpLogsPath = "/v1/logs"
+)
+
+// Maps the Cloud Logging severities to the OpenTelemetry severity numbers
+var otlpSeverities = map[logging.Severity]logspb.SeverityNumber{
+	logging.Default:   logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED,
+	logging.Debug:     logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+	logging.Info:      logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+	logging.Notice:    logspb.SeverityNumber_SEVERITY_NUMBER_INFO2,
+	logging.Warning:   logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+	logging.Error:     logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	logging.Critical:  logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	logging.Alert:     logspb.SeverityNumber_SEVERITY_NUMBER_FATAL2,
+	logging.Emergency: logspb.SeverityNumber_SEVERITY_NUMBER_FATAL3,
+}
+
+// otlpSink exports entries as OTLP logs to an OpenTelemetry collector, over HTTP with protobuf encoding or gRPC
+type otlpSink struct {
+	*batchSink
+	resource *resourcepb.Resource
+	headers  map[string]string
+
+	// http/protobuf
+	url        string
+	httpClient *http.Client
+
+	// grpc
+	conn       *grpc.ClientConn
+	grpcClient collogspb.LogsServiceClient
+}
+
+func newOtlpSink(ctx context.Context, info logger.Info, data templateData) (*otlpSink, error) {
+	endpoint := info.Config[otlpEndpointKey]
+	if endpoint == "" {
+		return nil, errors.New(otlpEndpointKey + " is required")
+	}
+	headers, err := parseKeyValues(info.Config[otlpHeadersKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", otlpHeadersKey, err)
+	}
+	opts, err := parseBatchOptions(info.Config, otlpSinkKind)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &otlpSink{
+		resource: newOtlpResource(data),
+		headers:  headers,
+	}
+	name := endpoint
+	switch protocol := info.Config[otlpProtocolKey]; protocol {
+	case "", otlpProtocolHTTP:
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", otlpEndpointKey, err)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = otlpLogsPath
+		}
+		s.url = u.String()
+		s.httpClient = &http.Client{}
+		name = redactURL(s.url)
+	case otlpProtocolGRPC:
+		transportCredentials := credentials.NewTLS(&tls.Config{})
+		if info.Config[otlpInsecureKey] == "true" {
+			transportCredentials = insecure.NewCredentials()
+		}
+		s.conn, err = grpc.Dial(endpoint, grpc.WithTransportCredentials(transportCredentials))
+		if err != nil {
+			return nil, err
+		}
+		s.grpcClient = collogspb.NewLogsServiceClient(s.conn)
+	default:
+		return nil, fmt.Errorf("unsupported %s %q, must be %s or %s", otlpProtocolKey, protocol, otlpProtocolHTTP, otlpProtocolGRPC)
+	}
+
+	s.batchSink = newBatchSink(ctx, otlpSinkKind+":"+name, opts, s.send)
+	return s, nil
+}
+
+func (s *otlpSink) Close() error {
+	err := s.batchSink.Close()
+	if s.conn != nil {
+		if closeErr := s.conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *otlpSink) send(ctx context.Context, batch []logging.Entry) error {
+	records := make([]*logspb.LogRecord, 0, len(batch))
+	for _, entry := range batch {
+		records = append(records, newOtlpLogRecord(entry))
+	}
+	req := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: s.resource,
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: name},
+				LogRecords: records,
+			}},
+		}},
+	}
+
+	if s.grpcClient != nil {
+		return s.sendGRPC(ctx, req)
+	}
+	return s.sendHTTP(ctx, req)
+}
+
+func (s *otlpSink) sendHTTP(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range s.headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := s.httpClient.Do(httpReq)
+	if err != nil {
+		return retryableError{redactRequestError(err)}
+	}
+	defer resp.Body.Close()
+	return checkHTTPResponse(resp)
+}
+
+func (s *otlpSink) sendGRPC(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	if len(s.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(s.headers))
+	}
+	_, err := s.grpcClient.Export(ctx, req)
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+		return retryableError{err}
+	}
+	return err
+}
+
+// newOtlpResource describes the container and the instance it runs on with the OpenTelemetry semantic conventions
+func newOtlpResource(data templateData) *resourcepb.Resource {
+	var attributes []*commonpb.KeyValue
+	addAttribute := func(k, v string) {
+		if v != "" {
+			attributes = append(attributes, otlpStringAttribute(k, v))
+		}
+	}
+	if c := data.Container; c != nil {
+		addAttribute("service.name", strings.TrimPrefix(c.Name, "/"))
+		addAttribute("container.name", strings.TrimPrefix(c.Name, "/"))
+		addAttribute("container.id", c.ID)
+		addAttribute("container.image.name", c.ImageName)
+		addAttribute("container.image.id", c.ImageID)
+		addAttribute("container.command", c.Command)
+		for k, v := range c.Metadata {
+			addAttribute("container.metadata."+k, v)
+		}
+	}
+	addAttribute("host.name", data.Hostname)
+	if i := data.Instance; i != nil {
+		addAttribute("host.id", i.ID)
+		addAttribute("cloud.availability_zone", i.Zone)
+	}
+	return &resourcepb.Resource{Attributes: attributes}
+}
+
+func newOtlpLogRecord(entry logging.Entry) *logspb.LogRecord {
+	record := &logspb.LogRecord{
+		TimeUnixNano:         uint64(entry.Timestamp.UnixNano()),
+		ObservedTimeUnixNano: uint64(time.Now().UnixNano()),
+		SeverityNumber:       otlpSeverities[entry.Severity],
+	}
+	if entry.Severity != logging.Default {
+		record.SeverityText = entry.Severity.String()
+	}
+
+	// The trace may be in the projects/<project>/traces/<trace id> format used by Cloud Logging
+	if traceID, err := hex.DecodeString(entry.Trace[strings.LastIndex(entry.Trace, "/")+1:]); err == nil && len(traceID) == 16 {
+		record.TraceId = traceID
+	}
+	if spanID, err := hex.DecodeString(entry.SpanID); err == nil && len(spanID) == 8 {
+		record.SpanId = spanID
+	}
+	if entry.TraceSampled {
+		record.Flags = 1 // sampled flag of the W3C trace flags
+	}
+
+	for k, v := range entry.Labels {
+		record.Attributes = append(record.Attributes, otlpStringAttribute(k, v))
+	}
+	if sl := entry.SourceLocation; sl != nil {
+		record.Attributes = append(record.Attributes,
+			otlpStringAttribute("code.filepath", sl.File),
+			&commonpb.KeyValue{Key: "code.lineno", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: sl.Line}}},
+			otlpStringAttribute("code.function", sl.Function),
+		)
+	}
+	if hr := newJSONEntry(entry).HTTPRequest; hr != nil {
+		record.Attributes = append(record.Attributes,
+			otlpStringAttribute("http.request.method", hr.RequestMethod),
+			otlpStringAttribute("url.full", hr.RequestURL),
+			&commonpb.KeyValue{Key: "http.response.status_code", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(hr.Status)}}},
+			otlpStringAttribute("client.address", hr.RemoteIP),
+			otlpStringAttribute("user_agent.original", hr.UserAgent),
+		)
+	}
+
+	// The container and instance information is part of the resource. If the payload has a message it becomes the
+	// body, and the rest of the fields are added as attributes
+	switch payload := entry.Payload.(type) {
+	case dockerLogEntry:
+		record.Body = otlpValue(payload.Message)
+	case map[string]any:
+		for k, v := range payload {
+			switch k {
+			case "container", "instance":
+			case "message":
+				record.Body = otlpValue(v)
+			default:
+				record.Attributes = append(record.Attributes, &commonpb.KeyValue{Key: k, Value: otlpValue(v)})
+			}
+		}
+	default:
+		record.Body = otlpValue(payload)
+	}
+	return record
+}
+
+func otlpStringAttribute(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+// otlpValue converts values unmarshalled from JSON to OTLP values
+func otlpValue(v any) *commonpb.AnyValue {
+	switch v := v.(type) {
+	case nil:
+		return &commonpb.AnyValue{}
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}
+	case float64:
+		if v == float64(int64(v)) {
+			return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v}}
+	case []any:
+		values := make([]*commonpb.AnyValue, 0, len(v))
+		for _, e := range v {
+			values = append(values, otlpValue(e))
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+	case map[string]any:
+		kvs := make([]*commonpb.KeyValue, 0, len(v))
+		for k, e := range v {
+			kvs = append(kvs, &commonpb.KeyValue{Key: k, Value: otlpValue(e)})
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: kvs}}}
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return otlpValue(fmt.Sprint(v))
+		}
+		return otlpValue(string(b))
+	}
+}
+
+// parseKeyValues parses comma separated key=value pairs
+func parseKeyValues(s string) (map[string]string, error) {
+	kvs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, found := strings.Cut(kv, "=")
+		if !found || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("%q must have the format key=value", kv)
+		}
+		kvs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return kvs, nil
+}
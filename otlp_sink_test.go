@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpAttributes returns the attributes as strings, formatting the other values with their protobuf text format
+func otlpAttributes(kvs []*commonpb.KeyValue) map[string]string {
+	attributes := make(map[string]string)
+	for _, kv := range kvs {
+		switch v := kv.GetValue().GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			attributes[kv.GetKey()] = v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			attributes[kv.GetKey()] = strconv.FormatInt(v.IntValue, 10)
+		case *commonpb.AnyValue_BoolValue:
+			attributes[kv.GetKey()] = strconv.FormatBool(v.BoolValue)
+		default:
+			attributes[kv.GetKey()] = kv.GetValue().String()
+		}
+	}
+	return attributes
+}
+
+func TestOtlpSink(t *testing.T) {
+	h := newTestHarness(t)
+	collector := newCaptureServer(t, alwaysOK)
+
+	file := h.startContainer(t, logger.Info{
+		ContainerID:        "otlp-container",
+		ContainerName:      "/checkout",
+		ContainerImageName: "checkout:1.2",
+		Config: map[string]string{
+			sinksKey:        otlpSinkKind,
+			otlpEndpointKey: collector.URL,
+			otlpHeadersKey:  "Authorization=Bearer token",
+			"extract-gcp":   "true",
+		},
+	},
+		`{"severity":"WARNING","message":"payment declined","user":"alice","retries":3,"ok":false,`+
+			`"logging.googleapis.com/labels":{"team":"payments"},`+
+			`"logging.googleapis.com/trace":"projects/p/traces/0123456789abcdef0123456789abcdef",`+
+			`"logging.googleapis.com/spanId":"0123456789abcdef","logging.googleapis.com/trace_sampled":true}`,
+		"plain text line",
+	)
+	h.call(t, "StopLogging", StopLoggingRequest{File: file})
+	h.waitForStopped(t, 5*time.Second)
+
+	requests := collector.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 export request, got %d", len(requests))
+	}
+	if got := requests[0].header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization header = %q, want the otlp-headers value", got)
+	}
+	var req collogspb.ExportLogsServiceRequest
+	if err := proto.Unmarshal(requests[0].body, &req); err != nil {
+		t.Fatalf("error decoding export request: %v", err)
+	}
+	if len(req.ResourceLogs) != 1 || len(req.ResourceLogs[0].ScopeLogs) != 1 {
+		t.Fatalf("expected 1 resource and scope, got %v", &req)
+	}
+
+	resource := otlpAttributes(req.ResourceLogs[0].Resource.GetAttributes())
+	for k, want := range map[string]string{
+		"service.name":         "checkout",
+		"container.name":       "checkout",
+		"container.id":         "otlp-container",
+		"container.image.name": "checkout:1.2",
+		"host.name":            hostHostname(),
+	} {
+		if got := resource[k]; got != want {
+			t.Errorf("resource attribute %s = %q, want %q", k, got, want)
+		}
+	}
+
+	records := req.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 2 {
+		t.Fatalf("expected 2 log records, got %d", len(records))
+	}
+	record := records[0]
+	if got, want := record.TimeUnixNano, uint64(time.Date(2024, 3, 15, 11, 21, 40, 0, time.UTC).UnixNano()); got != want {
+		t.Errorf("time = %d, want %d", got, want)
+	}
+	if record.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_WARN || record.SeverityText != "Warning" {
+		t.Errorf("severity = %v %q, want WARN Warning", record.SeverityNumber, record.SeverityText)
+	}
+	if got := record.Body.GetStringValue(); got != "payment declined" {
+		t.Errorf("body = %q, want the message", got)
+	}
+	if got := hex.EncodeToString(record.TraceId); got != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("trace id = %s, want the id of the trace", got)
+	}
+	if got := hex.EncodeToString(record.SpanId); got != "0123456789abcdef" {
+		t.Errorf("span id = %s, want the span id", got)
+	}
+	if record.Flags != 1 {
+		t.Errorf("flags = %d, want the sampled flag", record.Flags)
+	}
+	attributes := otlpAttributes(record.Attributes)
+	for k, want := range map[string]string{"team": "payments", "user": "alice", "retries": "3", "ok": "false"} {
+		if got := attributes[k]; got != want {
+			t.Errorf("attribute %s = %q, want %q", k, got, want)
+		}
+	}
+	for _, k := range []string{"message", "severity", "container", "instance"} {
+		if _, found := attributes[k]; found {
+			t.Errorf("attribute %s should not be set", k)
+		}
+	}
+
+	if got := records[1].Body.GetStringValue(); got != "plain text line" {
+		t.Errorf("body = %q, want the line", got)
+	}
+	if records[1].SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED || records[1].SeverityText != "" {
+		t.Errorf("severity = %v %q, want it unspecified", records[1].SeverityNumber, records[1].SeverityText)
+	}
+}
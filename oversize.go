@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	maxEntrySizeKey   = "gcp-max-entry-size"
+	oversizePolicyKey = "gcp-oversize-policy"
+
+	oversizeTruncate   = "truncate"
+	oversizeSplit      = "split"
+	oversizeDropFields = "drop-fields"
+	oversizeDrop       = "drop"
+
+	// defaultMaxEntrySize is the limit of Cloud Logging on the size of a LogEntry
+	defaultMaxEntrySize = 256 * 1000
+
+	// jsonToProtoFactor bounds how much larger the LogEntry of a payload is than the JSON it was parsed from, the
+	// worst case being arrays of small numbers, which take 2 bytes in JSON and 11 bytes as a protobuf Value
+	jsonToProtoFactor = 6
+
+	splitProducer     = "ngcplogs/split"
+	splitIndexLabel   = "split_index"
+	splitTotalLabel   = "split_total"
+	droppedFieldsName = "droppedFields"
+	truncatedMarker   = "…[truncated %d bytes]"
+
+	// defaultResourceSize is assumed for the resource detected by the logging library when none is configured
+	defaultResourceSize = 512
+
+	// varintSlack covers the varint length prefixes that change size when a string is shortened
+	varintSlack = 10
+)
+
+// oversizeStats counts the actions taken on the oversized entries of a container
+type oversizeStats struct {
+	Truncated     uint64 `json:"truncated"`
+	Split         uint64 `json:"split"`
+	FieldsDropped uint64 `json:"fieldsDropped"`
+	Dropped       uint64 `json:"dropped"`
+}
+
+// oversizeGuard keeps the entries written to Cloud Logging under its size limit, which otherwise rejects the whole
+// request the entry is sent in. Oversized entries are truncated, split, stripped of their largest fields or dropped
+// depending on the policy, falling back to the next action when one is not enough
+type oversizeGuard struct {
+	policy      string
+	maxSize     int
+	project     string
+	containerID string
+	// metadataSize is the size of the instance and container info included in the payload of every entry
+	metadataSize int
+	// overhead is the size of the log name and resource, which are set for the whole request but count towards
+	// the size of every entry
+	overhead int
+
+	stats oversizeStats
+}
+
+func newOversizeGuard(cfg map[string]string, project string, sinks []Sink, resource *mrpb.MonitoredResource, instance *instanceInfo, container *containerInfo) (*oversizeGuard, error) {
+	g := &oversizeGuard{
+		policy:      oversizeTruncate,
+		maxSize:     defaultMaxEntrySize,
+		project:     project,
+		containerID: container.ID,
+	}
+	switch policy := cfg[oversizePolicyKey]; policy {
+	case "":
+	case oversizeTruncate, oversizeSplit, oversizeDropFields, oversizeDrop:
+		g.policy = policy
+	default:
+		return nil, fmt.Errorf("unsupported %s %q, must be one of %s, %s, %s or %s", oversizePolicyKey, policy, oversizeTruncate, oversizeSplit, oversizeDropFields, oversizeDrop)
+	}
+	if v, found := cfg[maxEntrySizeKey]; found {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 || size > defaultMaxEntrySize {
+			return nil, fmt.Errorf("%s must be a positive integer up to %d, got %q", maxEntrySizeKey, defaultMaxEntrySize, v)
+		}
+		g.maxSize = size
+	}
+
+	metadata, err := json.Marshal(dockerLogEntry{Instance: instance, Container: container})
+	if err != nil {
+		return nil, err
+	}
+	g.metadataSize = len(metadata)
+
+	for _, s := range sinks {
+		var dst destination
+		switch d := s.(type) {
+		case *gcpDestination:
+			dst = d.destination
+		case *lazySink:
+			dst = d.destination
+		default:
+			continue
+		}
+		overhead := proto.Size(&loggingpb.LogEntry{
+			LogName:  "projects/" + dst.project + "/logs/" + url.PathEscape(dst.logName),
+			Resource: resource,
+		})
+		if resource == nil {
+			overhead += defaultResourceSize
+		}
+		g.overhead = max(g.overhead, overhead)
+	}
+	return g, nil
+}
+
+// apply returns the entries to write to Cloud Logging in place of the given entry, which was built from a line of
+// lineSize bytes
+func (g *oversizeGuard) apply(entry logging.Entry, lineSize int) []logging.Entry {
+	// Everything in the entry comes from the line or the metadata, so the exact size only needs to be computed
+	// when they could add up to more than the limit
+	if (lineSize+g.metadataSize)*jsonToProtoFactor+g.overhead < g.maxSize {
+		return []logging.Entry{entry}
+	}
+	size, err := g.size(entry)
+	if err != nil || size <= g.maxSize {
+		return []logging.Entry{entry}
+	}
+
+	if g.policy == oversizeTruncate {
+		if truncated, ok := g.truncate(entry, size); ok {
+			g.count(&g.stats.Truncated, oversizeTruncate, size)
+			return []logging.Entry{truncated}
+		}
+	}
+	if g.policy == oversizeSplit {
+		if split, ok := g.split(entry); ok {
+			g.count(&g.stats.Split, oversizeSplit, size)
+			return split
+		}
+	}
+	if g.policy != oversizeDrop {
+		if stripped, ok := g.dropFields(entry); ok {
+			g.count(&g.stats.FieldsDropped, oversizeDropFields, size)
+			return []logging.Entry{stripped}
+		}
+	}
+	g.count(&g.stats.Dropped, oversizeDrop, size)
+	return nil
+}
+
+func (g *oversizeGuard) size(entry logging.Entry) (int, error) {
+	pb, err := logging.ToLogEntry(entry, g.project)
+	if err != nil {
+		return 0, err
+	}
+	return proto.Size(pb) + g.overhead, nil
+}
+
+func (g *oversizeGuard) fits(entry logging.Entry) bool {
+	size, err := g.size(entry)
+	return err == nil && size <= g.maxSize
+}
+
+// count records the action taken, logging the first time and every 1000th time after for the container
+func (g *oversizeGuard) count(counter *uint64, action string, size int) {
+	if i := atomic.AddUint64(counter, 1); i%1000 == 1 {
+		slog.Warn("oversized entry", "id", g.containerID, "action", action, "size", size, "maxSize", g.maxSize, "count", i)
+	}
+}
+
+func (g *oversizeGuard) snapshot() oversizeStats {
+	return oversizeStats{
+		Truncated:     atomic.LoadUint64(&g.stats.Truncated),
+		Split:         atomic.LoadUint64(&g.stats.Split),
+		FieldsDropped: atomic.LoadUint64(&g.stats.FieldsDropped),
+		Dropped:       atomic.LoadUint64(&g.stats.Dropped),
+	}
+}
+
+// truncate shortens the message of the entry by the excess size, appending a marker with the number of bytes removed
+func (g *oversizeGuard) truncate(entry logging.Entry, size int) (logging.Entry, bool) {
+	msg, found := messageOf(entry)
+	if !found {
+		return entry, false
+	}
+	excess := size - g.maxSize
+	keep := validUTF8Prefix(msg, len(msg)-excess-len(fmt.Sprintf(truncatedMarker, excess))-varintSlack)
+	if keep <= 0 {
+		return entry, false
+	}
+	truncated := withMessage(entry, msg[:keep]+fmt.Sprintf(truncatedMarker, len(msg)-keep))
+	return truncated, g.fits(truncated)
+}
+
+// split divides the message of the entry into several entries that fit the limit. They are grouped by an operation,
+// with the split_index and split_total labels to put them back in order, since logging.Entry has no split field
+func (g *oversizeGuard) split(entry logging.Entry) ([]logging.Entry, bool) {
+	msg, found := messageOf(entry)
+	if !found {
+		return nil, false
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, false
+	}
+	base := withMessage(entry, "")
+	base.Operation = &loggingpb.LogEntryOperation{Id: hex.EncodeToString(id), Producer: splitProducer, First: true, Last: true}
+	base.Labels = maps.Clone(entry.Labels)
+	if base.Labels == nil {
+		base.Labels = make(map[string]string)
+	}
+	base.Labels[splitIndexLabel] = "000000"
+	base.Labels[splitTotalLabel] = "000000"
+	baseSize, err := g.size(base)
+	if err != nil {
+		return nil, false
+	}
+	chunkSize := g.maxSize - baseSize - varintSlack
+	if chunkSize < utf8.UTFMax {
+		return nil, false
+	}
+
+	var chunks []string
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > chunkSize {
+			n = validUTF8Prefix(msg, chunkSize)
+		}
+		chunks = append(chunks, msg[:n])
+		msg = msg[n:]
+	}
+
+	entries := make([]logging.Entry, len(chunks))
+	for i, chunk := range chunks {
+		e := withMessage(base, chunk)
+		e.Labels = maps.Clone(base.Labels)
+		e.Labels[splitIndexLabel] = strconv.Itoa(i)
+		e.Labels[splitTotalLabel] = strconv.Itoa(len(chunks))
+		e.Operation = &loggingpb.LogEntryOperation{
+			Id:       base.Operation.Id,
+			Producer: splitProducer,
+			First:    i == 0,
+			Last:     i == len(chunks)-1,
+		}
+		entries[i] = e
+	}
+	return entries, true
+}
+
+// dropFields removes the largest fields of a JSON payload until the entry fits, listing them in droppedFields. The
+// container and instance info are kept
+func (g *oversizeGuard) dropFields(entry logging.Entry) (logging.Entry, bool) {
+	m, isMap := entry.Payload.(map[string]any)
+	if !isMap {
+		return entry, false
+	}
+	sizes := make(map[string]int, len(m))
+	var names []string
+	for k, v := range m {
+		if k == "container" || k == "instance" {
+			continue
+		}
+		b, _ := json.Marshal(v)
+		sizes[k] = len(b)
+		names = append(names, k)
+	}
+	slices.SortFunc(names, func(a, b string) int { return sizes[b] - sizes[a] })
+
+	stripped := maps.Clone(m)
+	var dropped []any
+	for _, k := range names {
+		delete(stripped, k)
+		dropped = append(dropped, k)
+		stripped[droppedFieldsName] = dropped
+		entry.Payload = stripped
+		if g.fits(entry) {
+			return entry, true
+		}
+	}
+	return entry, false
+}
+
+// messageOf returns the message of the payload of an entry created by nGCPLogger, which is the whole payload for the
+// lines that failed to parse as JSON
+func messageOf(entry logging.Entry) (string, bool) {
+	switch payload := entry.Payload.(type) {
+	case string:
+		return payload, true
+	case dockerLogEntry:
+		return payload.Message, true
+	case map[string]any:
+		msg, isString := payload["message"].(string)
+		return msg, isString
+	}
+	return "", false
+}
+
+// withMessage returns a copy of the entry with the message of the payload replaced, leaving the original untouched
+func withMessage(entry logging.Entry, msg string) logging.Entry {
+	switch payload := entry.Payload.(type) {
+	case string:
+		entry.Payload = msg
+	case dockerLogEntry:
+		payload.Message = msg
+		entry.Payload = payload
+	case map[string]any:
+		m := maps.Clone(payload)
+		m["message"] = msg
+		entry.Payload = m
+	}
+	return entry
+}
+
+// validUTF8Prefix returns the largest length up to n that does not cut s in the middle of a rune
+func validUTF8Prefix(s string, n int) int {
+	if n >= len(s) {
+		return len(s)
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return n
+}
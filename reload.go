@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// reloadDelay groups the several events editors and config management tools generate when writing a file
+const reloadDelay = 200 * time.Millisecond
+
+// watchHostConfig reloads the configuration file when it changes, or when the plugin receives SIGHUP. The directory
+// of the file is watched rather than the file itself, so replacing it by renaming another file over it is noticed
+func watchHostConfig(d *driver) error {
+	file := os.Getenv(configFileEnv)
+	if file == "" {
+		return nil
+	}
+	path := hostConfigPath(file)
+
+	changes := make(chan struct{}, 1)
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("error watching %s: %w", file, err)
+	}
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE | unix.IN_ATTRIB)
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("error watching %s: %w", file, err)
+	}
+	go readInotifyEvents(fd, changes)
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-changes:
+			case <-hangups:
+				slog.Info("received SIGHUP, reloading the configuration file")
+			}
+			time.Sleep(reloadDelay)
+			select {
+			case <-changes:
+			default:
+			}
+			d.reloadConfig(path)
+		}
+	}()
+	return nil
+}
+
+// readInotifyEvents signals changes every time events are read from the inotify file descriptor. Any event in the
+// directory is a change, since a file can be replaced in many ways, such as through the symlinks of Kubernetes
+// volumes. Reloading an unchanged file does nothing
+func readInotifyEvents(fd int, changes chan<- struct{}) {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			slog.Error("error watching the configuration file, it is only reloaded on SIGHUP", "error", err)
+			return
+		}
+		if n < unix.SizeofInotifyEvent {
+			continue
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reloadConfig loads the configuration file again and applies it to the running containers, whose loggers are
+// replaced if their options changed. An invalid file is rejected, keeping the current configuration
+func (d *driver) reloadConfig(path string) {
+	c, err := parseConfigFile(path)
+	if err != nil {
+		slog.Error("rejected the configuration file, keeping the current one", "file", path, "error", err)
+		return
+	}
+	if current := hostConfig.Load(); current != nil && current.digest == c.digest {
+		slog.Debug("configuration file unchanged", "file", path)
+		return
+	}
+	hostConfig.Store(c)
+
+	d.mu.Lock()
+	pairs := make([]*logPair, 0, len(d.fileToLogWrapperMap))
+	for _, lp := range d.fileToLogWrapperMap {
+		pairs = append(pairs, lp)
+	}
+	d.mu.Unlock()
+
+	var reloaded int
+	for _, lp := range pairs {
+		info := lp.info
+		info.Config = lp.rawConfig
+		cfg, err := resolveOptions(info)
+		if err == nil {
+			err = ValidateLogOpts(cfg)
+		}
+		var changed bool
+		if err == nil {
+			changed, err = lp.reload(cfg)
+		}
+		if err != nil {
+			slog.Error("error applying the configuration file, keeping the current options", "id", lp.info.ContainerID, "error", err)
+			continue
+		}
+		if changed {
+			reloaded++
+		}
+	}
+	slog.Info("reloaded the configuration file", "file", path, "containers", len(pairs), "changed", reloaded)
+}
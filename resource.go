@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/docker/docker/daemon/logger"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+const (
+	resourceTypeKey      = "resource-type"
+	resourceLocationKey  = "resource-location"
+	resourceNamespaceKey = "resource-namespace"
+	resourceNodeIDKey    = "resource-node-id"
+	resourceJobKey       = "resource-job"
+	resourceTaskIDKey    = "resource-task-id"
+
+	resourceTypeGCEInstance = "gce_instance"
+	resourceTypeGenericNode = "generic_node"
+	resourceTypeGenericTask = "generic_task"
+	resourceTypeGlobal      = "global"
+)
+
+var (
+	resourceTypes = []string{
+		resourceTypeGCEInstance,
+		resourceTypeGenericNode,
+		resourceTypeGenericTask,
+		resourceTypeGlobal,
+	}
+
+	// Default label templates for the generic resource types, used when the
+	// corresponding log-opt is not set
+	resourceLabelDefaults = map[string]string{
+		resourceLocationKey:  "{{with .Instance}}{{.Zone}}{{end}}",
+		resourceNamespaceKey: "",
+		resourceNodeIDKey:    "{{.Hostname}}",
+		resourceJobKey:       "{{.Container.ImageName}}",
+		resourceTaskIDKey:    "{{.Container.ID}}",
+	}
+)
+
+// templateData is the data available to the templates used in options, such as the resource labels
+type templateData struct {
+	Container *containerInfo
+	Instance  *instanceInfo
+	Hostname  string
+}
+
+// newMonitoredResource builds the monitored resource the container's logs are attributed to. A nil resource
+// means the logging library default (global) should be used.
+func newMonitoredResource(info logger.Info, instance *instanceInfo, container *containerInfo) (*mrpb.MonitoredResource, error) {
+	resourceType := info.Config[resourceTypeKey]
+	if resourceType == "" {
+		if instance == nil {
+			return nil, nil
+		}
+		resourceType = resourceTypeGCEInstance
+	}
+
+	switch resourceType {
+	case resourceTypeGlobal:
+		return nil, nil
+	case resourceTypeGCEInstance:
+		if instance == nil {
+			return nil, fmt.Errorf("%s resource requires running on GCE or setting the %s and %s options", resourceTypeGCEInstance, logZoneKey, logIDKey)
+		}
+		return &mrpb.MonitoredResource{
+			Type: resourceTypeGCEInstance,
+			Labels: map[string]string{
+				"instance_id": instance.ID,
+				"zone":        instance.Zone,
+			},
+		}, nil
+	}
+
+	data := templateData{
+		Container: container,
+		Instance:  instance,
+		Hostname:  hostHostname(),
+	}
+
+	var labelKeys map[string]string
+	switch resourceType {
+	case resourceTypeGenericNode:
+		labelKeys = map[string]string{
+			"location":  resourceLocationKey,
+			"namespace": resourceNamespaceKey,
+			"node_id":   resourceNodeIDKey,
+		}
+	case resourceTypeGenericTask:
+		labelKeys = map[string]string{
+			"location":  resourceLocationKey,
+			"namespace": resourceNamespaceKey,
+			"job":       resourceJobKey,
+			"task_id":   resourceTaskIDKey,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported %s %q, must be one of %s", resourceTypeKey, resourceType, strings.Join(resourceTypes, ", "))
+	}
+
+	labels := make(map[string]string, len(labelKeys))
+	for label, optKey := range labelKeys {
+		tmpl, found := info.Config[optKey]
+		if !found {
+			tmpl = resourceLabelDefaults[optKey]
+		}
+		value, err := executeTemplate(optKey, tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		labels[label] = value
+	}
+	if labels["location"] == "" {
+		labels["location"] = "global"
+	}
+
+	return &mrpb.MonitoredResource{
+		Type:   resourceType,
+		Labels: labels,
+	}, nil
+}
+
+// executeTemplate evaluates the template in the value of the optKey option
+func executeTemplate(optKey, tmpl string, data templateData) (string, error) {
+	t, err := template.New(optKey).Option("missingkey=zero").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s template: %w", optKey, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error executing %s template: %w", optKey, err)
+	}
+	return buf.String(), nil
+}
+
+// hostHostname returns the hostname of the docker host, read through the /host mount, falling back to the
+// hostname of the plugin itself
+func hostHostname() string {
+	if h, err := os.ReadFile("/host/etc/hostname"); err == nil {
+		if hostname := strings.TrimSpace(string(h)); hostname != "" {
+			return hostname
+		}
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
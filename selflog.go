@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"google.golang.org/api/option"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+// Plugin settings configuring the plugin's own logs, set with docker plugin set
+const (
+	selfLogProjectEnv = "self-log-project"
+	selfLogNameEnv    = "self-log-name"
+	selfLogLevelEnv   = "self-log-level"
+
+	defaultSelfLogName = "ngcplogs-plugin"
+)
+
+// selfLogger writes the plugin's own logs to Cloud Logging, nil unless self-log-project is set and the plugin
+// connected to Cloud Logging
+var selfLogger atomic.Pointer[logging.Logger]
+
+// setupSelfLogging sends the plugin's own logs to Cloud Logging when self-log-project is set, besides the stderr
+// handler. The plugin connects in the background, retrying with exponential backoff, so it starts even when Cloud
+// Logging is unreachable, and the logs are only written to stderr until it is connected. Errors are only written to
+// stderr, so failing to write them doesn't loop back
+func setupSelfLogging(stderr slog.Handler) error {
+	project := os.Getenv(selfLogProjectEnv)
+	if project == "" {
+		return nil
+	}
+	logName := os.Getenv(selfLogNameEnv)
+	if logName == "" {
+		logName = defaultSelfLogName
+	}
+	level := slog.LevelInfo
+	if v := os.Getenv(selfLogLevelEnv); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("invalid %s: %w", selfLogLevelEnv, err)
+		}
+	}
+	ep, err := parseEndpointConfig(map[string]string{
+		endpointKey: os.Getenv(endpointKey),
+		insecureKey: os.Getenv(insecureKey),
+		caFileKey:   os.Getenv(caFileKey),
+	})
+	if err != nil {
+		return fmt.Errorf("invalid endpoint for the plugin logs: %w", err)
+	}
+
+	go func() {
+		backoff := initialConnectBackoff
+		for {
+			c, err := newSelfLogClient(project, ep)
+			if err == nil {
+				c.OnError = func(err error) {
+					slog.New(stderr).Error("error writing plugin logs to Cloud Logging", "error", err)
+				}
+				initGCP()
+				l := c.Logger(logName, logging.CommonResource(hostResource()))
+				selfLogger.Store(l)
+				slog.SetDefault(slog.New(teeHandler{stderr, &cloudLogHandler{logger: l, level: level}}))
+				slog.Info("sending the plugin logs to Cloud Logging", "project", project, "logName", logName)
+				return
+			}
+			slog.Warn("unable to connect to Cloud Logging for the plugin logs, retrying", "retry", backoff, "error", err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxConnectBackoff)
+		}
+	}()
+	return nil
+}
+
+// newSelfLogClient connects to Cloud Logging with the credentials-* and gcp-endpoint plugin settings, like the
+// destinations of the containers
+func newSelfLogClient(project string, ep endpointConfig) (*logging.Client, error) {
+	creds, err := credentialsOf(os.Getenv)
+	if err != nil {
+		return nil, fmt.Errorf("error loading the credentials: %w", err)
+	}
+	conn, err := dialLogging(creds, ep)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting: %w", err)
+	}
+	c, err := logging.NewClient(context.Background(), project, option.WithGRPCConn(conn))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error creating the client: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.Ping(ctx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("unable to connect or authenticate with Google Cloud Logging: %w", err)
+	}
+	return c, nil
+}
+
+// hostResource is the monitored resource of the host the plugin runs on
+func hostResource() *mrpb.MonitoredResource {
+	if onGCE {
+		return &mrpb.MonitoredResource{
+			Type: resourceTypeGCEInstance,
+			Labels: map[string]string{
+				"instance_id": instanceID,
+				"zone":        zone,
+			},
+		}
+	}
+	return &mrpb.MonitoredResource{
+		Type: resourceTypeGenericNode,
+		Labels: map[string]string{
+			"location":  "global",
+			"namespace": name,
+			"node_id":   hostHostname(),
+		},
+	}
+}
+
+// teeHandler sends records to all of its handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slices.ContainsFunc(t, func(h slog.Handler) bool { return h.Enabled(ctx, level) })
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// cloudLogHandler writes records as Cloud Logging entries, with the attributes in the JSON payload
+type cloudLogHandler struct {
+	logger *logging.Logger
+	level  slog.Leveler
+	attrs  []groupedAttr
+	groups []string
+}
+
+type groupedAttr struct {
+	groups []string
+	attr   slog.Attr
+}
+
+func (h *cloudLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *cloudLogHandler) Handle(_ context.Context, r slog.Record) error {
+	payload := map[string]any{"message": r.Message}
+	for _, ga := range h.attrs {
+		addAttr(payload, ga.groups, ga.attr)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(payload, h.groups, a)
+		return true
+	})
+
+	entry := logging.Entry{
+		Timestamp: r.Time,
+		Severity:  slogSeverity(r.Level),
+		Payload:   payload,
+	}
+	if r.Time.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		entry.SourceLocation = &loggingpb.LogEntrySourceLocation{
+			File:     frame.File,
+			Line:     int64(frame.Line),
+			Function: frame.Function,
+		}
+	}
+	h.logger.Log(entry)
+	return nil
+}
+
+func (h *cloudLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = slices.Clip(h.attrs)
+	for _, a := range attrs {
+		h2.attrs = append(h2.attrs, groupedAttr{groups: h.groups, attr: a})
+	}
+	return &h2
+}
+
+func (h *cloudLogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.groups = append(slices.Clip(h.groups), name)
+	return &h2
+}
+
+// addAttr adds the attribute to the payload, nested in the maps of its groups
+func addAttr(payload map[string]any, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	m := payload
+	for _, g := range groups {
+		nested, isMap := m[g].(map[string]any)
+		if !isMap {
+			nested = make(map[string]any)
+			m[g] = nested
+		}
+		m = nested
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		if a.Key == "" {
+			for _, ga := range attrs {
+				addAttr(m, nil, ga)
+			}
+			return
+		}
+		for _, ga := range attrs {
+			addAttr(m, []string{a.Key}, ga)
+		}
+	case slog.KindTime:
+		m[a.Key] = a.Value.Time().Format(time.RFC3339Nano)
+	case slog.KindDuration:
+		m[a.Key] = a.Value.Duration().String()
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			m[a.Key] = v.Error()
+		case fmt.Stringer:
+			m[a.Key] = v.String()
+		default:
+			m[a.Key] = v
+		}
+	default:
+		m[a.Key] = a.Value.Any()
+	}
+}
+
+func slogSeverity(level slog.Level) logging.Severity {
+	switch {
+	case level >= slog.LevelError:
+		return logging.Error
+	case level >= slog.LevelWarn:
+		return logging.Warning
+	case level >= slog.LevelInfo:
+		return logging.Info
+	default:
+		return logging.Debug
+	}
+}
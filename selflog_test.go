@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	ltype "google.golang.org/genproto/googleapis/logging/type"
+
+	"dgcplogs/internal/fakelogging"
+)
+
+func TestSelfLogging(t *testing.T) {
+	server, err := fakelogging.Start()
+	if err != nil {
+		t.Fatalf("error starting fake logging server: %v", err)
+	}
+	t.Cleanup(server.Close)
+	opts, err := endpointConfig{endpoint: server.Addr(), insecure: true}.clientOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := logging.NewClient(context.Background(), testProject, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	var stderr bytes.Buffer
+	cloudLogger := c.Logger(defaultSelfLogName, logging.CommonResource(hostResource()))
+	log := slog.New(teeHandler{
+		slog.NewTextHandler(&stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		&cloudLogHandler{logger: cloudLogger, level: slog.LevelInfo},
+	})
+	log.Debug("only on stderr")
+	log.With("id", "abc").WithGroup("flush").Warn("flush timed out",
+		"error", errors.New("deadline exceeded"),
+		"timeout", 5*time.Second,
+		slog.Group("sink", "kind", "loki"),
+	)
+	if err := cloudLogger.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(stderr.String(), "only on stderr") || !strings.Contains(stderr.String(), "flush timed out") {
+		t.Errorf("expected both records on stderr, got %q", stderr.String())
+	}
+	entries := server.Entries(defaultSelfLogName)
+	if len(entries) != 1 {
+		t.Fatalf("expected only the warning to be sent, got %d entries", len(entries))
+	}
+	entry := entries[0]
+	if entry.Severity != ltype.LogSeverity_WARNING {
+		t.Errorf("severity = %v, want WARNING", entry.Severity)
+	}
+	if !strings.HasSuffix(entry.GetSourceLocation().GetFile(), "selflog_test.go") {
+		t.Errorf("source location = %v, want the caller in selflog_test.go", entry.GetSourceLocation())
+	}
+	var payload map[string]any
+	b, err := entry.GetJsonPayload().MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"message": "flush timed out",
+		"id":      "abc",
+		"flush": map[string]any{
+			"error":   "deadline exceeded",
+			"timeout": "5s",
+			"sink":    map[string]any{"kind": "loki"},
+		},
+	}
+	if got, want := mustJSON(t, payload), mustJSON(t, want); got != want {
+		t.Errorf("payload = %s, want %s", got, want)
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSelfLoggingConnectsInBackground(t *testing.T) {
+	// The server only starts once the plugin is set up, like when the network isn't up yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	t.Setenv(selfLogProjectEnv, testProject)
+	t.Setenv(endpointKey, addr)
+	t.Setenv(insecureKey, "true")
+	prevDefault := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(prevDefault)
+		selfLogger.Store(nil)
+	})
+
+	if err := setupSelfLogging(slog.NewTextHandler(io.Discard, nil)); err != nil {
+		t.Fatalf("expected the plugin to start without Cloud Logging, got %v", err)
+	}
+	server, err := fakelogging.StartAt(addr)
+	if err != nil {
+		t.Fatalf("error starting fake logging server: %v", err)
+	}
+	t.Cleanup(server.Close)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for selfLogger.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the plugin logs to connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	slog.Warn("logged once connected")
+	if err := selfLogger.Load().Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, e := range server.Entries(defaultSelfLogName) {
+		messages = append(messages, e.GetJsonPayload().GetFields()["message"].GetStringValue())
+	}
+	if !slices.Contains(messages, "logged once connected") {
+		t.Errorf("expected the plugin logs to be sent to the gcp-endpoint setting, got %v", messages)
+	}
+}
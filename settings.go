@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// logLevelEnv is the plugin setting with the minimum level of the plugin's own logs
+const logLevelEnv = "log-level"
+
+// pluginDefaultOptions are the log-opts that can also be set for all containers as plugin settings, with
+// docker plugin set. The log-opts of the daemon and of the container take precedence over them
+var pluginDefaultOptions = []string{
+	projectOptKey,
+	clientCredentialsFile,
+	clientCredentialsJSON,
+	impersonateKey,
+	delegatesKey,
+	credentialsProfileKey,
+	endpointKey,
+	insecureKey,
+	caFileKey,
+}
+
+// credentialsOptions are the options selecting the credentials of a container. They are overridden as a whole, so the
+// credentials set at one level are never mixed with those of a lower one, such as a plugin credentials-profile
+// taking precedence over the credentials-file of a container, or impersonating with it
+var credentialsOptions = []string{
+	clientCredentialsFile,
+	clientCredentialsJSON,
+	impersonateKey,
+	delegatesKey,
+	credentialsProfileKey,
+}
+
+// resolveOptions returns the options of a container, which are the plugin settings, overridden by the profile of
+// the configuration file that applies to the container, overridden by its log-opts. The log-opts of the daemon are
+// already merged into those of the container by docker
+func resolveOptions(info logger.Info) (map[string]string, error) {
+	cfg := make(map[string]string)
+	settings := make(map[string]string)
+	for _, k := range pluginDefaultOptions {
+		if v := os.Getenv(k); v != "" {
+			settings[k] = v
+		}
+	}
+	overrideOptions(cfg, settings)
+
+	if c := hostConfig.Load(); c != nil {
+		name, p, err := c.profileOf(info)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" {
+			slog.Debug("applying profile", "id", info.ContainerID, "profile", name)
+		}
+		overrideOptions(cfg, p.Options)
+	} else if name, found := info.Config[profileKey]; found {
+		return nil, fmt.Errorf("%s %q is set, but no configuration file is loaded, see the %s plugin setting", profileKey, name, configFileEnv)
+	}
+
+	overrideOptions(cfg, info.Config)
+	return cfg, nil
+}
+
+// overrideOptions copies the options of the level into cfg, replacing all the credentials options of cfg if the
+// level sets any of them
+func overrideOptions(cfg, level map[string]string) {
+	for _, k := range credentialsOptions {
+		if _, found := level[k]; found {
+			for _, k := range credentialsOptions {
+				delete(cfg, k)
+			}
+			break
+		}
+	}
+	maps.Copy(cfg, level)
+}
+
+// setupLogging configures the plugin's own logs with the log-level setting, writing them to stderr, which ends up in
+// the docker daemon logs, and to Cloud Logging if self-log-project is set
+func setupLogging() error {
+	level := slog.LevelInfo
+	if v := os.Getenv(logLevelEnv); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("invalid %s: %w", logLevelEnv, err)
+		}
+	}
+	stderr := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(stderr))
+	return setupSelfLogging(stderr)
+}
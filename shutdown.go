@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// shutdownTimeoutEnv is the plugin setting with the milliseconds the plugin waits for the containers' entries to
+	// be written when it is stopped
+	shutdownTimeoutEnv = "shutdown-timeout"
+
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+var (
+	errShuttingDown = errors.New("the ngcplogs plugin is shutting down")
+
+	// shuttingDown is set once the plugin started shutting down. New containers are refused, and the sinks keep the
+	// entries of their disk buffers for the next start of the plugin instead of discarding them
+	shuttingDown atomic.Bool
+)
+
+func parseShutdownTimeout() (time.Duration, error) {
+	v := os.Getenv(shutdownTimeoutEnv)
+	if v == "" {
+		return defaultShutdownTimeout, nil
+	}
+	timeout, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of milliseconds, got %q", shutdownTimeoutEnv, v)
+	}
+	return time.Duration(timeout) * time.Millisecond, nil
+}
+
+// handleShutdown shuts the driver down when the plugin receives SIGTERM or SIGINT, such as when it is disabled or
+// upgraded, and exits once the entries are written or the shutdown-timeout setting expired
+func handleShutdown(d *driver) error {
+	timeout, err := parseShutdownTimeout()
+	if err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		slog.Info("shutting down", "signal", sig, "timeout", timeout)
+		code := 0
+		if err := d.shutdown(timeout); err != nil {
+			slog.Error("error shutting down", "error", err)
+			code = 1
+		}
+		if l := selfLogger.Load(); l != nil {
+			if err := l.Flush(); err != nil {
+				slog.Error("error flushing the plugin logs", "error", err)
+			}
+		}
+		os.Exit(code)
+	}()
+	return nil
+}
+
+// shutdown stops accepting new containers, then reads what the docker daemon already wrote to the FIFO of every
+// container and flushes their loggers, all in parallel, along with those of the containers still being stopped. It
+// gives up on the containers still pending after timeout
+func (d *driver) shutdown(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	d.mu.Lock()
+	shuttingDown.Store(true)
+	pairs := make([]*logPair, 0, len(d.fileToLogWrapperMap)+len(d.stopping))
+	for _, lp := range d.fileToLogWrapperMap {
+		pairs = append(pairs, lp)
+	}
+	for lp := range d.stopping {
+		pairs = append(pairs, lp)
+	}
+	d.mu.Unlock()
+
+	var pending sync.WaitGroup
+	var remaining atomic.Int64
+	remaining.Store(int64(len(pairs)))
+	for _, lp := range pairs {
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			lp.drain(deadline)
+			remaining.Add(-1)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("flushed all containers", "containers", len(pairs))
+		return nil
+	case <-time.After(time.Until(deadline)):
+		var dropped int64
+		for _, lp := range pairs {
+			select {
+			case <-lp.done:
+			default:
+				dropped += lp.logger().metrics.queued.Load()
+			}
+		}
+		return fmt.Errorf("timed out after %s flushing %d of %d containers, dropping %d entries that were not written", timeout, remaining.Load(), len(pairs), dropped)
+	}
+}
+
+// drain waits until the entries written to the FIFO of the pair were read, or the deadline, then closes it and waits
+// for consumeLog to flush and close the logger
+func (lp *logPair) drain(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		n, err := pendingBytes(lp.logFile)
+		if err != nil {
+			slog.Debug("unable to tell whether the FIFO was read", "id", lp.info.ContainerID, "error", err)
+			break
+		}
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lp.logFile.Close()
+	<-lp.done
+}
+
+// pendingBytes returns the number of bytes written to the FIFO that weren't read yet
+func pendingBytes(f io.Reader) (int, error) {
+	sc, isConn := f.(syscall.Conn)
+	if !isConn {
+		return 0, errors.New("not a file")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	var ioctlErr error
+	// TIOCINQ is FIONREAD on Linux
+	if err := rc.Control(func(fd uintptr) {
+		n, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCINQ)
+	}); err != nil {
+		return 0, err
+	}
+	return n, ioctlErr
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	sinksKey    = "sinks"
+	filePathKey = "file-path"
+
+	gcpSinkKind     = "gcp"
+	fileSinkKind    = "file"
+	stdoutSinkKind  = "stdout"
+	webhookSinkKind = "webhook"
+	otlpSinkKind    = "otlp"
+	lokiSinkKind    = "loki"
+	syslogSinkKind  = "syslog"
+
+	// outputDir is where the output mount of the plugin is mounted, which file sinks write to
+	outputDir       = "/output"
+	defaultFilePath = "ngcplogs/{{.Container.ID}}.ndjson"
+)
+
+var (
+	sinkKinds = []string{
+		gcpSinkKind,
+		fileSinkKind,
+		stdoutSinkKind,
+		webhookSinkKind,
+		otlpSinkKind,
+		lokiSinkKind,
+		syslogSinkKind,
+	}
+
+	// stdoutSink is shared by all containers, so lines of different containers are not interleaved
+	stdoutSink = &writerSink{name: stdoutSinkKind, w: os.Stdout}
+)
+
+// Sink receives the entries processed by nGCPLogger and writes them to a backend
+type Sink interface {
+	fmt.Stringer
+
+	// Log writes the entry to the sink. Sinks may buffer entries, so a nil error does not guarantee the entry
+	// reached the backend
+	Log(entry logging.Entry) error
+	// Flush blocks until all buffered entries have been written to the backend
+	Flush() error
+	// Close flushes and releases the resources held by the sink
+	Close() error
+}
+
+// parseSinkKinds parses the comma separated list of sinks of the sinks option, defaulting to Cloud Logging
+func parseSinkKinds(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return []string{gcpSinkKind}, nil
+	}
+	var kinds []string
+	for _, kind := range strings.Split(s, ",") {
+		kind = strings.TrimSpace(kind)
+		if !slices.Contains(sinkKinds, kind) {
+			return nil, fmt.Errorf("unsupported sink %q in %s, must be one of %s", kind, sinksKey, strings.Join(sinkKinds, ", "))
+		}
+		if !slices.Contains(kinds, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds, nil
+}
+
+// newSinks creates the sinks of the given kinds, except Cloud Logging which is created by newGcpSinks. Their sends
+// are aborted when ctx is canceled
+func newSinks(ctx context.Context, info logger.Info, kinds []string, data templateData) ([]Sink, error) {
+	var sinks []Sink
+	for _, kind := range kinds {
+		var s Sink
+		var err error
+		switch kind {
+		case gcpSinkKind:
+			continue
+		case fileSinkKind:
+			s, err = newFileSink(info, data)
+		case stdoutSinkKind:
+			s = stdoutSink
+		case webhookSinkKind:
+			s, err = newWebhookSink(ctx, info)
+		case otlpSinkKind:
+			s, err = newOtlpSink(ctx, info, data)
+		case lokiSinkKind:
+			s, err = newLokiSink(ctx, info, data)
+		case syslogSinkKind:
+			s, err = newSyslogSink(ctx, info, data)
+		}
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("error creating %s sink: %w", kind, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// isGcpSink reports whether the sink writes to Cloud Logging
+func isGcpSink(s Sink) bool {
+	switch s.(type) {
+	case *gcpDestination, *lazySink:
+		return true
+	}
+	return false
+}
+
+func closeSinks(sinks []Sink) error {
+	var firstErr error
+	for _, s := range sinks {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// jsonEntry is the JSON representation of a processed entry used by the sinks that don't write to Cloud Logging.
+// The field names follow the ones of Cloud Logging's LogEntry
+type jsonEntry struct {
+	Timestamp      time.Time                         `json:"timestamp"`
+	Severity       string                            `json:"severity"`
+	Labels         map[string]string                 `json:"labels,omitempty"`
+	Trace          string                            `json:"trace,omitempty"`
+	SpanID         string                            `json:"spanId,omitempty"`
+	TraceSampled   bool                              `json:"traceSampled,omitempty"`
+	SourceLocation *loggingpb.LogEntrySourceLocation `json:"sourceLocation,omitempty"`
+	HTTPRequest    *jsonHTTPRequest                  `json:"httpRequest,omitempty"`
+	Payload        any                               `json:"jsonPayload,omitempty"`
+}
+
+type jsonHTTPRequest struct {
+	RequestMethod string `json:"requestMethod,omitempty"`
+	RequestURL    string `json:"requestUrl,omitempty"`
+	RequestSize   int64  `json:"requestSize,omitempty"`
+	Status        int    `json:"status,omitempty"`
+	ResponseSize  int64  `json:"responseSize,omitempty"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp,omitempty"`
+	Referer       string `json:"referer,omitempty"`
+	Latency       string `json:"latency,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+func newJSONEntry(entry logging.Entry) jsonEntry {
+	je := jsonEntry{
+		Timestamp:      entry.Timestamp,
+		Severity:       entry.Severity.String(),
+		Labels:         entry.Labels,
+		Trace:          entry.Trace,
+		SpanID:         entry.SpanID,
+		TraceSampled:   entry.TraceSampled,
+		SourceLocation: entry.SourceLocation,
+		Payload:        entry.Payload,
+	}
+	if hr := entry.HTTPRequest; hr != nil {
+		je.HTTPRequest = &jsonHTTPRequest{
+			RequestSize:  hr.RequestSize,
+			Status:       hr.Status,
+			ResponseSize: hr.ResponseSize,
+			RemoteIP:     hr.RemoteIP,
+		}
+		if hr.Latency > 0 {
+			je.HTTPRequest.Latency = fmt.Sprintf("%.9fs", hr.Latency.Seconds())
+		}
+		if r := hr.Request; r != nil {
+			je.HTTPRequest.RequestMethod = r.Method
+			je.HTTPRequest.Protocol = r.Proto
+			je.HTTPRequest.UserAgent = r.UserAgent()
+			je.HTTPRequest.Referer = r.Referer()
+			if r.URL != nil {
+				je.HTTPRequest.RequestURL = r.URL.String()
+			}
+		}
+	}
+	return je
+}
+
+// writerSink writes entries as newline delimited JSON
+type writerSink struct {
+	name string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newFileSink(info logger.Info, data templateData) (*writerSink, error) {
+	pathTmpl, found := info.Config[filePathKey]
+	if !found {
+		pathTmpl = defaultFilePath
+	}
+	path, err := executeTemplate(filePathKey, pathTmpl, data)
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Join(outputDir, path)
+	if rel, err := filepath.Rel(outputDir, path); err != nil || !filepath.IsLocal(rel) {
+		return nil, fmt.Errorf("%s %q is outside of the output mount", filePathKey, pathTmpl)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{name: fileSinkKind + ":" + path, w: f}, nil
+}
+
+func (s *writerSink) String() string {
+	return s.name
+}
+
+func (s *writerSink) Log(entry logging.Entry) error {
+	b, err := json.Marshal(newJSONEntry(entry))
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(b)
+	return err
+}
+
+func (s *writerSink) Flush() error {
+	return nil
+}
+
+func (s *writerSink) Close() error {
+	if f, isFile := s.w.(*os.File); isFile && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+// retryableError marks errors after which sending a batch may succeed if retried
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+// redactURL returns the scheme and host of a URL, which name the HTTP sinks in the logs, metrics and health reports,
+// since webhook and push URLs often hold credentials in their userinfo, path or query
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "[redacted]"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// redactRequestError replaces the URL of the error of an HTTP request by its redacted form
+func redactRequestError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+	return err
+}
+
+// checkHTTPResponse returns an error for unsuccessful responses, which is retryable for rate limiting and server errors
+func checkHTTPResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return retryableError{fmt.Errorf("%w: %w", errRateLimited, err)}
+	}
+	if resp.StatusCode >= 500 {
+		return retryableError{err}
+	}
+	return err
+}
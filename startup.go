@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/apiv2/loggingpb"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	startupModeKey       = "startup-mode"
+	startupBufferKey     = "startup-buffer"
+	startupBufferSizeKey = "startup-buffer-size"
+
+	startupModeStrict = "strict"
+	startupModeLazy   = "lazy"
+
+	startupBufferMemory = "memory"
+	startupBufferDisk   = "disk"
+
+	defaultStartupBufferSize = 10000
+
+	initialConnectBackoff = time.Second
+	maxConnectBackoff     = time.Minute
+
+	sinkStateConnecting = "connecting"
+	sinkStateConnected  = "connected"
+	sinkStateRunning    = "running"
+)
+
+var (
+	errStartupBufferFull = errors.New("startup buffer is full, entry dropped")
+
+	// pendingBufferSuffix replaces the .buf suffix of the disk buffers kept when the plugin shuts down
+	pendingBufferSuffix = ".pending"
+
+	// bufferDir is where disk buffers are kept, on the propagated mount of the plugin, which is outside its rootfs
+	// so the buffers kept when the plugin shuts down survive an upgrade
+	bufferDir = "/var/lib/ngcplogs/buffer"
+)
+
+// startupOptions configures how the Cloud Logging destinations of a container are connected to. In the default
+// strict mode, starting the container fails if Cloud Logging can't be reached. In lazy mode, the container starts
+// right away and entries are buffered until the destinations are connected in the background
+type startupOptions struct {
+	lazy       bool
+	buffer     string
+	bufferSize int
+}
+
+func parseStartupOptions(cfg map[string]string) (startupOptions, error) {
+	opts := startupOptions{
+		buffer:     startupBufferMemory,
+		bufferSize: defaultStartupBufferSize,
+	}
+	switch mode := cfg[startupModeKey]; mode {
+	case "", startupModeStrict:
+	case startupModeLazy:
+		opts.lazy = true
+	default:
+		return opts, fmt.Errorf("unsupported %s %q, must be %s or %s", startupModeKey, mode, startupModeStrict, startupModeLazy)
+	}
+	switch buffer := cfg[startupBufferKey]; buffer {
+	case "":
+	case startupBufferMemory, startupBufferDisk:
+		opts.buffer = buffer
+	default:
+		return opts, fmt.Errorf("unsupported %s %q, must be %s or %s", startupBufferKey, buffer, startupBufferMemory, startupBufferDisk)
+	}
+	if v, found := cfg[startupBufferSizeKey]; found {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return opts, fmt.Errorf("%s must be a positive integer, got %q", startupBufferSizeKey, v)
+		}
+		opts.bufferSize = size
+	}
+	return opts, nil
+}
+
+// sinkHealth is the state of a sink reported by the health endpoint
+type sinkHealth struct {
+	Sink     string `json:"sink"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+	Buffered int    `json:"buffered,omitempty"`
+	Dropped  uint64 `json:"dropped,omitempty"`
+}
+
+// healthReporter is implemented by the sinks that have more to report than being running
+type healthReporter interface {
+	health() sinkHealth
+}
+
+func healthOf(s Sink) sinkHealth {
+	if r, isReporter := s.(healthReporter); isReporter {
+		return r.health()
+	}
+	return sinkHealth{Sink: s.String(), State: sinkStateRunning}
+}
+
+// lazySink is a Cloud Logging destination connected in the background, retrying with exponential backoff. Entries
+// logged before it is connected are buffered, and written in order once it is
+type lazySink struct {
+	destination
+	connect func() (*gcpDestination, error)
+	losses  *lossTracker
+
+	mu      sync.Mutex
+	dst     *gcpDestination
+	buffer  entryBuffer
+	lastErr error
+	dropped uint64
+	// abandoned is set when the sink was closed without waiting for the connection attempt in progress
+	abandoned bool
+
+	closed    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLazySink(containerID string, dst destination, opts startupOptions, losses *lossTracker, connect func() (*gcpDestination, error)) (*lazySink, error) {
+	var buffer entryBuffer
+	if opts.buffer == startupBufferDisk {
+		var err error
+		buffer, err = newDiskBuffer(bufferDir, bufferFilePattern(containerID, dst), dst.project, opts.bufferSize)
+		if err != nil {
+			return nil, fmt.Errorf("error creating the disk buffer of %s: %w", dst, err)
+		}
+	} else {
+		buffer = &memoryBuffer{maxEntries: opts.bufferSize}
+	}
+
+	s := &lazySink{
+		destination: dst,
+		connect:     connect,
+		losses:      losses,
+		buffer:      buffer,
+		closed:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// bufferFilePattern is the os.CreateTemp pattern of the disk buffers of a destination. The names are made unique, since
+// the sinks of a container are replaced by new ones while they are still open when its configuration is reloaded
+func bufferFilePattern(containerID string, dst destination) string {
+	return containerID + "-" + strings.ReplaceAll(dst.String(), "/", "_") + "-*.buf"
+}
+
+func (s *lazySink) run() {
+	defer close(s.done)
+	backoff := initialConnectBackoff
+	for {
+		dst, err := s.connect()
+		if err == nil {
+			s.mu.Lock()
+			if s.abandoned {
+				s.mu.Unlock()
+				if err := dst.Close(); err != nil {
+					slog.Error("error closing a sink connected after being closed", "sink", s, "error", err)
+				}
+				return
+			}
+			buffered := s.buffer.len()
+			if err := s.buffer.drain(func(entry logging.Entry) { dst.Log(entry) }); err != nil {
+				slog.Error("error replaying buffered entries", "sink", s, "error", err)
+			}
+			s.dst = dst
+			s.lastErr = nil
+			s.mu.Unlock()
+			slog.Info("connected to Cloud Logging", "sink", s, "buffered", buffered)
+			return
+		}
+
+		s.mu.Lock()
+		s.lastErr = err
+		s.mu.Unlock()
+		slog.Warn("unable to connect to Cloud Logging, retrying", "sink", s, "retry", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-s.closed:
+			return
+		}
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+func (s *lazySink) Log(entry logging.Entry) error {
+	s.mu.Lock()
+	dst := s.dst
+	if dst == nil {
+		defer s.mu.Unlock()
+		if err := s.buffer.push(entry); err != nil {
+			s.dropped++
+			return err
+		}
+		return nil
+	}
+	s.mu.Unlock()
+	return dst.Log(entry)
+}
+
+func (s *lazySink) Flush() error {
+	s.mu.Lock()
+	dst := s.dst
+	buffered := s.buffer.len()
+	s.mu.Unlock()
+	if dst == nil {
+		return fmt.Errorf("%s is not connected yet, %d entries are buffered", s, buffered)
+	}
+	return dst.Flush()
+}
+
+// Close stops connecting, and discards the buffered entries if the sink never got connected. When the plugin is
+// shutting down, the entries of a disk buffer are kept instead, for the next sink of the container and destination
+func (s *lazySink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	// A connection attempt in progress is given the chance to succeed, unless the plugin is shutting down, since
+	// attempts can take longer than the shutdown-timeout setting
+	waited := !shuttingDown.Load()
+	if waited {
+		<-s.done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.abandoned = !waited
+	if s.dst != nil {
+		return errors.Join(s.buffer.close(), s.dst.Close())
+	}
+	if disk, isDisk := s.buffer.(*diskBuffer); isDisk && shuttingDown.Load() && disk.len() > 0 {
+		slog.Warn("keeping buffered entries on disk until the container logs again", "sink", s, "buffered", disk.len(), "error", s.lastErr)
+		return disk.persist()
+	}
+	if buffered := s.buffer.len(); buffered > 0 {
+		slog.Error("discarding buffered entries of a sink that never connected", "sink", s, "buffered", buffered, "error", s.lastErr)
+		s.losses.add(s.String(), lossDeliveryFailed, buffered)
+	}
+	return s.buffer.close()
+}
+
+func (s *lazySink) health() sinkHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := sinkHealth{
+		Sink:     s.String(),
+		State:    sinkStateConnected,
+		Buffered: s.buffer.len(),
+		Dropped:  s.dropped,
+	}
+	if s.dst == nil {
+		h.State = sinkStateConnecting
+		if s.lastErr != nil {
+			h.Error = s.lastErr.Error()
+		}
+	}
+	return h
+}
+
+// entryBuffer holds entries until they can be written. Implementations are not safe for concurrent use
+type entryBuffer interface {
+	// push adds the entry to the buffer, failing with errStartupBufferFull if it is full
+	push(entry logging.Entry) error
+	// drain calls fn with every buffered entry in order, and empties the buffer
+	drain(fn func(entry logging.Entry)) error
+	len() int
+	// close empties the buffer and releases its resources
+	close() error
+}
+
+type memoryBuffer struct {
+	entries    []logging.Entry
+	maxEntries int
+}
+
+func (b *memoryBuffer) push(entry logging.Entry) error {
+	if len(b.entries) >= b.maxEntries {
+		return errStartupBufferFull
+	}
+	b.entries = append(b.entries, entry)
+	return nil
+}
+
+func (b *memoryBuffer) drain(fn func(entry logging.Entry)) error {
+	for _, entry := range b.entries {
+		fn(entry)
+	}
+	b.entries = nil
+	return nil
+}
+
+func (b *memoryBuffer) len() int {
+	return len(b.entries)
+}
+
+func (b *memoryBuffer) close() error {
+	b.entries = nil
+	return nil
+}
+
+// diskBuffer keeps entries in a file as length delimited LogEntry protos, so buffering them doesn't grow the
+// memory usage of the plugin
+type diskBuffer struct {
+	f          *os.File
+	project    string
+	entries    int
+	maxEntries int
+}
+
+func newDiskBuffer(dir, pattern, project string, maxEntries int) (*diskBuffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	b := &diskBuffer{f: f, project: project, maxEntries: maxEntries}
+	b.restorePending(filepath.Join(dir, strings.TrimSuffix(pattern, ".buf")+pendingBufferSuffix))
+	return b, nil
+}
+
+// restorePending moves the entries of the disk buffers kept by the last shutdown of the plugin into b, so they are
+// written first. The entries that don't fit into b are dropped
+func (b *diskBuffer) restorePending(pattern string) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		slog.Error("error looking for the buffered entries of the last shutdown", "pattern", pattern, "error", err)
+		return
+	}
+	for _, file := range files {
+		n, err := b.appendFile(file)
+		if err != nil {
+			slog.Error("error restoring the buffered entries of the last shutdown", "file", file, "restored", n, "error", err)
+		} else {
+			slog.Info("restored the buffered entries of the last shutdown", "file", file, "restored", n)
+		}
+		if err := os.Remove(file); err != nil {
+			slog.Error("error removing restored buffer", "file", file, "error", err)
+		}
+	}
+}
+
+// appendFile appends the entries of a disk buffer file to b, returning how many were
+func (b *diskBuffer) appendFile(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var n int
+	for {
+		msg, err := readDelimited(r)
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if b.entries >= b.maxEntries {
+			return n, errStartupBufferFull
+		}
+		if _, err := b.f.Write(protowire.AppendBytes(nil, msg)); err != nil {
+			return n, err
+		}
+		b.entries++
+		n++
+	}
+}
+
+func (b *diskBuffer) push(entry logging.Entry) error {
+	if b.entries >= b.maxEntries {
+		return errStartupBufferFull
+	}
+	pb, err := logging.ToLogEntry(entry, b.project)
+	if err != nil {
+		return err
+	}
+	msg, err := proto.Marshal(pb)
+	if err != nil {
+		return err
+	}
+	if _, err := b.f.Write(protowire.AppendBytes(nil, msg)); err != nil {
+		return err
+	}
+	b.entries++
+	return nil
+}
+
+func (b *diskBuffer) drain(fn func(entry logging.Entry)) error {
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(b.f)
+	var readErr error
+	for i := 0; i < b.entries; i++ {
+		msg, err := readDelimited(r)
+		if err != nil {
+			readErr = fmt.Errorf("error reading entry %d of %d: %w", i+1, b.entries, err)
+			break
+		}
+		var pb loggingpb.LogEntry
+		if err := proto.Unmarshal(msg, &pb); err != nil {
+			readErr = fmt.Errorf("error decoding entry %d of %d: %w", i+1, b.entries, err)
+			break
+		}
+		fn(entryFromProto(&pb))
+	}
+	b.entries = 0
+	if err := b.f.Truncate(0); err != nil {
+		return errors.Join(readErr, err)
+	}
+	_, err := b.f.Seek(0, io.SeekStart)
+	return errors.Join(readErr, err)
+}
+
+func readDelimited(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	_, err = io.ReadFull(r, msg)
+	return msg, err
+}
+
+func (b *diskBuffer) len() int {
+	return b.entries
+}
+
+func (b *diskBuffer) close() error {
+	b.entries = 0
+	return errors.Join(b.f.Close(), os.Remove(b.f.Name()))
+}
+
+// persist closes the buffer, keeping its entries in a file restored by the next disk buffer of the same pattern
+func (b *diskBuffer) persist() error {
+	name := b.f.Name()
+	if err := b.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name, strings.TrimSuffix(name, ".buf")+pendingBufferSuffix)
+}
+
+// entryFromProto converts a LogEntry back into the entry it was created from by logging.ToLogEntry
+func entryFromProto(pb *loggingpb.LogEntry) logging.Entry {
+	entry := logging.Entry{
+		Timestamp:      pb.GetTimestamp().AsTime(),
+		Severity:       logging.Severity(pb.GetSeverity()),
+		InsertID:       pb.GetInsertId(),
+		Labels:         pb.GetLabels(),
+		Operation:      pb.GetOperation(),
+		Trace:          pb.GetTrace(),
+		SpanID:         pb.GetSpanId(),
+		TraceSampled:   pb.GetTraceSampled(),
+		SourceLocation: pb.GetSourceLocation(),
+		Resource:       pb.GetResource(),
+	}
+	switch payload := pb.GetPayload().(type) {
+	case *loggingpb.LogEntry_TextPayload:
+		entry.Payload = payload.TextPayload
+	case *loggingpb.LogEntry_JsonPayload:
+		entry.Payload = payload.JsonPayload
+	case *loggingpb.LogEntry_ProtoPayload:
+		entry.Payload = payload.ProtoPayload
+	}
+	if hr := pb.GetHttpRequest(); hr != nil {
+		u, err := url.Parse(hr.GetRequestUrl())
+		if err != nil {
+			u = &url.URL{}
+		}
+		r := &http.Request{
+			Method: hr.GetRequestMethod(),
+			URL:    u,
+			Proto:  hr.GetProtocol(),
+			Header: make(http.Header),
+		}
+		if hr.GetUserAgent() != "" {
+			r.Header.Set("User-Agent", hr.GetUserAgent())
+		}
+		if hr.GetReferer() != "" {
+			r.Header.Set("Referer", hr.GetReferer())
+		}
+		entry.HTTPRequest = &logging.HTTPRequest{
+			Request:                        r,
+			RequestSize:                    hr.GetRequestSize(),
+			Status:                         int(hr.GetStatus()),
+			ResponseSize:                   hr.GetResponseSize(),
+			Latency:                        hr.GetLatency().AsDuration(),
+			LocalIP:                        hr.GetServerIp(),
+			RemoteIP:                       hr.GetRemoteIp(),
+			CacheHit:                       hr.GetCacheHit(),
+			CacheValidatedWithOriginServer: hr.GetCacheValidatedWithOriginServer(),
+			CacheFillBytes:                 hr.GetCacheFillBytes(),
+			CacheLookup:                    hr.GetCacheLookup(),
+		}
+	}
+	return entry
+}
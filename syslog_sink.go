@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	syslogAddressKey       = "syslog-address"
+	syslogFacilityKey      = "syslog-facility"
+	syslogTagKey           = "syslog-tag"
+	syslogFramingKey       = "syslog-framing"
+	syslogPayloadKey       = "syslog-payload"
+	syslogTLSCACertKey     = "syslog-tls-ca-cert"
+	syslogTLSCertKey       = "syslog-tls-cert"
+	syslogTLSKeyKey        = "syslog-tls-key"
+	syslogTLSSkipVerifyKey = "syslog-tls-skip-verify"
+	syslogBatchSizeKey     = "syslog-batch-size"
+	syslogFlushIntervalKey = "syslog-flush-interval"
+	syslogMaxRetriesKey    = "syslog-max-retries"
+
+	syslogFramingOctetCounted   = "octet-counted"
+	syslogFramingNonTransparent = "non-transparent"
+
+	syslogPayloadJSON           = "json"
+	syslogPayloadStructuredData = "sd"
+
+	defaultSyslogTag = "{{.Container.Name}}"
+
+	// defaultSyslogFlushInterval is shorter than that of the other batch sinks, since batches of syslog messages are
+	// not sent as one request
+	defaultSyslogFlushInterval = 100 * time.Millisecond
+
+	// syslogSDID identifies the structured data element holding the payload fields. 32473 is the private
+	// enterprise number reserved for documentation by RFC 5612
+	syslogSDID = "ngcplogs@32473"
+)
+
+var (
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+		"", "", "", "", // reserved facilities 12 to 15
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+
+	// Maps the Cloud Logging severities to the syslog severities
+	syslogSeverities = map[logging.Severity]int{
+		logging.Default:   6,
+		logging.Debug:     7,
+		logging.Info:      6,
+		logging.Notice:    5,
+		logging.Warning:   4,
+		logging.Error:     3,
+		logging.Critical:  2,
+		logging.Alert:     1,
+		logging.Emergency: 0,
+	}
+
+	// syslogLineEscaper escapes the line breaks of the messages sent with non-transparent framing, which would
+	// otherwise end them
+	syslogLineEscaper = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+)
+
+// syslogSink forwards entries as RFC 5424 messages over UDP, TCP or TLS
+type syslogSink struct {
+	*batchSink
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	framing   string
+	payload   string
+	facility  int
+	hostname  string
+	appName   string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogSink(ctx context.Context, info logger.Info, data templateData) (*syslogSink, error) {
+	rawAddress := info.Config[syslogAddressKey]
+	if rawAddress == "" {
+		return nil, errors.New(syslogAddressKey + " is required")
+	}
+	u, err := url.Parse(rawAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", syslogAddressKey, err)
+	}
+
+	s := &syslogSink{
+		address:  u.Host,
+		facility: slices.Index(syslogFacilities, "daemon"),
+		hostname: syslogHeaderField(data.Hostname, 255),
+		framing:  info.Config[syslogFramingKey],
+		payload:  info.Config[syslogPayloadKey],
+	}
+
+	switch u.Scheme {
+	case "udp":
+		s.network = "udp"
+	case "tcp":
+		s.network = "tcp"
+	case "tls":
+		s.network = "tcp"
+		s.tlsConfig, err = newSyslogTLSConfig(info.Config, u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported %s scheme %q, must be udp, tcp or tls", syslogAddressKey, u.Scheme)
+	}
+
+	switch s.framing {
+	case "":
+		s.framing = syslogFramingOctetCounted
+	case syslogFramingOctetCounted, syslogFramingNonTransparent:
+	default:
+		return nil, fmt.Errorf("unsupported %s %q, must be %s or %s", syslogFramingKey, s.framing, syslogFramingOctetCounted, syslogFramingNonTransparent)
+	}
+
+	switch s.payload {
+	case "":
+		s.payload = syslogPayloadJSON
+	case syslogPayloadJSON, syslogPayloadStructuredData:
+	default:
+		return nil, fmt.Errorf("unsupported %s %q, must be %s or %s", syslogPayloadKey, s.payload, syslogPayloadJSON, syslogPayloadStructuredData)
+	}
+
+	if facility, found := info.Config[syslogFacilityKey]; found {
+		s.facility = slices.Index(syslogFacilities, facility)
+		if s.facility < 0 || facility == "" {
+			return nil, fmt.Errorf("unsupported %s %q", syslogFacilityKey, facility)
+		}
+	}
+
+	tagTmpl, found := info.Config[syslogTagKey]
+	if !found {
+		tagTmpl = defaultSyslogTag
+	}
+	tag, err := executeTemplate(syslogTagKey, tagTmpl, data)
+	if err != nil {
+		return nil, err
+	}
+	s.appName = syslogHeaderField(strings.TrimPrefix(tag, "/"), 48)
+
+	opts, err := parseBatchOptions(info.Config, syslogSinkKind)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := info.Config[syslogFlushIntervalKey]; !found {
+		opts.flushInterval = defaultSyslogFlushInterval
+	}
+	s.batchSink = newBatchSink(ctx, syslogSinkKind+":"+rawAddress, opts, s.send)
+	return s, nil
+}
+
+func newSyslogTLSConfig(cfg map[string]string, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: cfg[syslogTLSSkipVerifyKey] == "true",
+	}
+	if caCert, found := cfg[syslogTLSCACertKey]; found {
+		pem, err := os.ReadFile(fmt.Sprintf("/host/%s", caCert))
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", syslogTLSCACertKey, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+	}
+	if cfg[syslogTLSCertKey] != "" || cfg[syslogTLSKeyKey] != "" {
+		cert, err := tls.LoadX509KeyPair(fmt.Sprintf("/host/%s", cfg[syslogTLSCertKey]), fmt.Sprintf("/host/%s", cfg[syslogTLSKeyKey]))
+		if err != nil {
+			return nil, fmt.Errorf("error loading the syslog client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (s *syslogSink) Close() error {
+	err := s.batchSink.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		if closeErr := s.conn.Close(); err == nil {
+			err = closeErr
+		}
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *syslogSink) send(ctx context.Context, batch []logging.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		var err error
+		dialer := &net.Dialer{}
+		if s.tlsConfig != nil {
+			s.conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}).DialContext(ctx, s.network, s.address)
+		} else {
+			s.conn, err = dialer.DialContext(ctx, s.network, s.address)
+		}
+		if err != nil {
+			s.conn = nil
+			return retryableError{err}
+		}
+	}
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	// Writes don't take a context, so a canceled send unblocks them through the deadline
+	conn := s.conn
+	stop := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(time.Now()) })
+	defer stop()
+
+	for _, entry := range batch {
+		msg, err := s.format(entry)
+		if err != nil {
+			return err
+		}
+		if s.network == "tcp" {
+			if s.framing == syslogFramingOctetCounted {
+				msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+			} else {
+				msg = append([]byte(syslogLineEscaper.Replace(string(msg))), '\n')
+			}
+		}
+		if _, err := s.conn.Write(msg); err != nil {
+			// The connection is dropped so the next attempt reconnects. Since syslog has no acknowledgements, the
+			// whole batch is sent again, and the entries written before the failure may be duplicated
+			s.conn.Close()
+			s.conn = nil
+			return retryableError{err}
+		}
+	}
+	return nil
+}
+
+// format builds the RFC 5424 message of the entry:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (s *syslogSink) format(entry logging.Entry) ([]byte, error) {
+	pri := s.facility*8 + syslogSeverities[entry.Severity]
+	header := fmt.Sprintf("<%d>1 %s %s %s - - ", pri, entry.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, s.appName)
+
+	if s.payload == syslogPayloadJSON {
+		msg, err := json.Marshal(entry.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(header+"- "), msg...), nil
+	}
+
+	sd, msg, err := syslogStructuredData(entry)
+	if err != nil {
+		return nil, err
+	}
+	if msg != "" {
+		sd += " " + msg
+	}
+	return []byte(header + sd), nil
+}
+
+// syslogStructuredData places the payload fields, trace and labels of the entry in a structured data element.
+// The message of the payload is returned separately, to be used as the MSG
+func syslogStructuredData(entry logging.Entry) (string, string, error) {
+	var fields map[string]any
+	switch payload := entry.Payload.(type) {
+	case map[string]any:
+		fields = payload
+	default:
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return "", "", err
+		}
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return "", "", err
+		}
+	}
+
+	var msg string
+	params := make(map[string]string)
+	for k, v := range fields {
+		if k == "message" {
+			if m, isString := v.(string); isString {
+				msg = strings.TrimRight(m, "\n")
+				continue
+			}
+		}
+		if str, isString := v.(string); isString {
+			params[k] = str
+		} else {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", "", err
+			}
+			params[k] = string(b)
+		}
+	}
+	for k, v := range entry.Labels {
+		params["labels."+k] = v
+	}
+	if entry.Trace != "" {
+		params["trace"] = entry.Trace
+	}
+	if entry.SpanID != "" {
+		params["spanId"] = entry.SpanID
+	}
+
+	names := make([]string, 0, len(params))
+	for k := range params {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	var sb strings.Builder
+	sb.WriteString("[" + syslogSDID)
+	for _, k := range names {
+		sb.WriteString(" " + syslogSDName(k) + `="`)
+		sb.WriteString(syslogSDValueEscaper.Replace(params[k]))
+		sb.WriteString(`"`)
+	}
+	sb.WriteString("]")
+	return sb.String(), msg, nil
+}
+
+var syslogSDValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogSDName converts a payload field name into a valid SD-NAME, which is limited to 32 printable ASCII
+// characters other than '=', ' ', ']' and '"'
+func syslogSDName(k string) string {
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, k)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// syslogHeaderField converts a value into a valid header field, which is limited to maxLen printable ASCII
+// characters, using the nil value when empty
+func syslogHeaderField(v string, maxLen int) string {
+	field := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, v)
+	if len(field) > maxLen {
+		field = field[:maxLen]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
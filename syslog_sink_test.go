@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// readSyslogStream accepts a connection on l, returning everything written to it until it is closed
+func readSyslogStream(t *testing.T, l net.Listener) <-chan []byte {
+	t.Helper()
+	stream := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			stream <- nil
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		stream <- b
+	}()
+	return stream
+}
+
+// splitOctetCounted splits a stream of octet-counted syslog messages, framed as MSG-LEN SP SYSLOG-MSG
+func splitOctetCounted(t *testing.T, b []byte) []string {
+	t.Helper()
+	var messages []string
+	for len(b) > 0 {
+		length, rest, found := bytes.Cut(b, []byte(" "))
+		n, err := strconv.Atoi(string(length))
+		if !found || err != nil || n > len(rest) {
+			t.Fatalf("invalid octet-counted framing at %q", b)
+		}
+		messages = append(messages, string(rest[:n]))
+		b = rest[n:]
+	}
+	return messages
+}
+
+func TestSyslogSink(t *testing.T) {
+	for _, framing := range []string{syslogFramingOctetCounted, syslogFramingNonTransparent} {
+		t.Run(framing, func(t *testing.T) {
+			h := newTestHarness(t)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			stream := readSyslogStream(t, l)
+
+			file := h.startContainer(t, logger.Info{
+				ContainerID: "syslog-container",
+				Config: map[string]string{
+					sinksKey:           syslogSinkKind,
+					syslogAddressKey:   "tcp://" + l.Addr().String(),
+					syslogFacilityKey:  "local0",
+					syslogTagKey:       "checkout",
+					syslogFramingKey:   framing,
+					syslogPayloadKey:   syslogPayloadStructuredData,
+					syslogBatchSizeKey: "1",
+				},
+			}, `{"severity":"ERROR","message":"line one\nline two","user":"alice"}`, "plain text line")
+			h.call(t, "StopLogging", StopLoggingRequest{File: file})
+			h.waitForStopped(t, 5*time.Second)
+
+			var messages []string
+			b := <-stream
+			if framing == syslogFramingOctetCounted {
+				messages = splitOctetCounted(t, b)
+			} else {
+				if !bytes.HasSuffix(b, []byte("\n")) {
+					t.Fatalf("expected the stream to end with a newline, got %q", b)
+				}
+				messages = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			}
+			if len(messages) != 2 {
+				t.Fatalf("expected 2 messages, got %q", messages)
+			}
+
+			// local0 is facility 16, error and informational are severities 3 and 6
+			hostname := syslogHeaderField(hostHostname(), 255)
+			wantMessage := "line one\nline two"
+			if framing == syslogFramingNonTransparent {
+				wantMessage = `line one\nline two`
+			}
+			for i, want := range []struct {
+				prefix string
+				sd     string
+				suffix string
+			}{
+				{"<131>1 2024-03-15T11:21:40.000000Z " + hostname + " checkout - - [ngcplogs@32473 ", `user="alice"`, "] " + wantMessage},
+				{"<134>1 2024-03-15T11:21:41.000000Z " + hostname + " checkout - - [ngcplogs@32473 ", "", "] plain text line"},
+			} {
+				msg := messages[i]
+				if !strings.HasPrefix(msg, want.prefix) || !strings.HasSuffix(msg, want.suffix) || !strings.Contains(msg, want.sd) {
+					t.Errorf("message %d = %q, want %q...%s...%q", i, msg, want.prefix, want.sd, want.suffix)
+				}
+			}
+		})
+	}
+}
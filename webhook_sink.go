@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/logging"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	webhookURLKey           = "webhook-url"
+	webhookBatchSizeKey     = "webhook-batch-size"
+	webhookFlushIntervalKey = "webhook-flush-interval"
+	webhookMaxRetriesKey    = "webhook-max-retries"
+)
+
+// webhookSink POSTs batches of entries as a JSON array to an HTTP endpoint
+type webhookSink struct {
+	*batchSink
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(ctx context.Context, info logger.Info) (*webhookSink, error) {
+	url := info.Config[webhookURLKey]
+	if url == "" {
+		return nil, errors.New(webhookURLKey + " is required")
+	}
+	opts, err := parseBatchOptions(info.Config, webhookSinkKind)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &webhookSink{
+		url:    url,
+		client: &http.Client{},
+	}
+	s.batchSink = newBatchSink(ctx, webhookSinkKind+":"+redactURL(url), opts, s.send)
+	return s, nil
+}
+
+func (s *webhookSink) send(ctx context.Context, batch []logging.Entry) error {
+	entries := make([]jsonEntry, 0, len(batch))
+	for _, entry := range batch {
+		entries = append(entries, newJSONEntry(entry))
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return retryableError{redactRequestError(err)}
+	}
+	defer resp.Body.Close()
+	return checkHTTPResponse(resp)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// webhookMessages returns the messages of the entries of a webhook request
+func webhookMessages(t *testing.T, req capturedRequest) []string {
+	t.Helper()
+	var entries []struct {
+		Payload struct {
+			Message string `json:"message"`
+		} `json:"jsonPayload"`
+	}
+	if err := json.Unmarshal(req.body, &entries); err != nil {
+		t.Fatalf("error decoding webhook request %s: %v", req.body, err)
+	}
+	var messages []string
+	for _, e := range entries {
+		messages = append(messages, e.Payload.Message)
+	}
+	return messages
+}
+
+func TestWebhookSink(t *testing.T) {
+	for name, tc := range map[string]struct {
+		statusOf  func(n int) int
+		batchSize string
+		lines     []string
+		want      [][]string
+	}{
+		"batches": {
+			statusOf:  alwaysOK,
+			batchSize: "2",
+			lines:     []string{"1", "2", "3", "4", "5"},
+			want:      [][]string{{"1", "2"}, {"3", "4"}, {"5"}},
+		},
+		"retries server errors": {
+			statusOf: func(n int) int {
+				if n == 0 {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusOK
+			},
+			batchSize: "10",
+			lines:     []string{"1", "2"},
+			want:      [][]string{{"1", "2"}, {"1", "2"}},
+		},
+		"retries dropped connections": {
+			statusOf: func(n int) int {
+				if n == 0 {
+					return 0
+				}
+				return http.StatusOK
+			},
+			batchSize: "10",
+			lines:     []string{"1", "2"},
+			want:      [][]string{{"1", "2"}, {"1", "2"}},
+		},
+		"does not retry client errors": {
+			statusOf:  func(int) int { return http.StatusBadRequest },
+			batchSize: "10",
+			lines:     []string{"1", "2"},
+			want:      [][]string{{"1", "2"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := newTestHarness(t)
+			webhook := newCaptureServer(t, tc.statusOf)
+
+			file := h.startContainer(t, logger.Info{
+				ContainerID: "webhook-container",
+				Config: map[string]string{
+					sinksKey:                webhookSinkKind,
+					webhookURLKey:           webhook.URL,
+					webhookBatchSizeKey:     tc.batchSize,
+					webhookFlushIntervalKey: "60000",
+				},
+			}, tc.lines...)
+			h.call(t, "StopLogging", StopLoggingRequest{File: file})
+			h.waitForStopped(t, 5*time.Second)
+
+			requests := webhook.received()
+			var got [][]string
+			for _, req := range requests {
+				got = append(got, webhookMessages(t, req))
+			}
+			if !slices.EqualFunc(got, tc.want, slices.Equal) {
+				t.Errorf("requests = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}